@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+//errCircuitOpen - returned instead of calling cloudflare while the circuit breaker is open
+var errCircuitOpen = errors.New("cloudflare calls paused after repeated failures (circuit breaker open)")
+
+//circuit breaker states
+const (
+	circuitClosed   = "closed"    //calls go through
+	circuitOpen     = "open"      //calls are skipped until the cooldown elapsed
+	circuitHalfOpen = "half-open" //a single trial call tells whether cloudflare recovered
+)
+
+//circuitBreaker - stops calling cloudflare after failureThreshold calls failed in a row (network errors, 429 and 5xx once retried),
+//so an outage isn't met with requests on every check. After cooldown one call is let through, its outcome closes or reopens the circuit.
+type circuitBreaker struct {
+	mutex         sync.Mutex
+	state         string
+	failures      int
+	openedAt      time.Time
+	trialInFlight bool
+}
+
+//cloudflareBreaker - shared by every cloudflare client, the checks all talk to the same api
+var cloudflareBreaker = &circuitBreaker{state: circuitClosed}
+
+//allow - whether a call may be sent now, moves an open circuit to half-open once cooldown elapsed
+func (breaker *circuitBreaker) allow(cooldown time.Duration) error {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	switch breaker.state {
+	case circuitOpen:
+		if time.Since(breaker.openedAt) < cooldown {
+			return errCircuitOpen
+		}
+		breaker.state = circuitHalfOpen
+		log.Println("circuit breaker half-open, trying a cloudflare call")
+		breaker.trialInFlight = true
+		return nil
+	case circuitHalfOpen:
+		//only the trial call goes through, records checked concurrently wait for its outcome
+		if breaker.trialInFlight {
+			return errCircuitOpen
+		}
+		breaker.trialInFlight = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+//record - counts the outcome of a call allowed by allow
+func (breaker *circuitBreaker) record(succeeded bool, failureThreshold int) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	breaker.trialInFlight = false
+	if succeeded {
+		if breaker.state != circuitClosed {
+			log.Printf("circuit breaker closed, cloudflare answered again after %s", time.Since(breaker.openedAt).Round(time.Second))
+			breaker.state = circuitClosed
+		}
+		breaker.failures = 0
+		return
+	}
+
+	breaker.failures++
+	if breaker.state == circuitHalfOpen || breaker.failures >= failureThreshold {
+		if breaker.state == circuitHalfOpen {
+			log.Println("error when calling cloudflare :- trial call failed, circuit breaker open again")
+		} else {
+			log.Printf("error when calling cloudflare :- %d calls failed in a row, circuit breaker open", breaker.failures)
+		}
+		breaker.state = circuitOpen
+		breaker.openedAt = time.Now()
+	}
+}
+
+//release - ends a call allowed by allow without counting it, e.g. when the check was cancelled
+func (breaker *circuitBreaker) release() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.trialInFlight = false
+}
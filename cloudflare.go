@@ -0,0 +1,745 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//HTTPDoer - sends http requests, satisfied by *http.Client and by stubs returning canned responses in tests
+type HTTPDoer interface {
+	Do(request *http.Request) (*http.Response, error)
+}
+
+//defaultAPIBaseURL - base of every cloudflare api endpoint
+const defaultAPIBaseURL = "https://api.cloudflare.com/client/v4"
+
+//cloudflareClient - talks to the cloudflare api at baseURL (defaultAPIBaseURL when empty) through doer using the auth and retry settings of configuration
+type cloudflareClient struct {
+	doer          HTTPDoer
+	configuration *Configuration
+	baseURL       string
+	//first delay between retries, retryDelaySeconds when zero
+	retryDelay time.Duration
+}
+
+//newCloudflareClient - creates a client sending its requests to apiBaseURL through the shared httpClient
+func newCloudflareClient(configuration *Configuration) *cloudflareClient {
+	return &cloudflareClient{doer: httpClient, configuration: configuration, baseURL: configuration.APIBaseURL}
+}
+
+//endpoint - url of the api path (e.g. /zones), joined to baseURL whether or not it ends with a slash
+func (client *cloudflareClient) endpoint(path string) string {
+	baseURL := client.baseURL
+	if baseURL == "" {
+		baseURL = defaultAPIBaseURL
+	}
+	return strings.TrimRight(baseURL, "/") + path
+}
+
+//recordsPerPage - records asked for in each page of the record list, the most cloudflare allows is 5000
+const recordsPerPage = 100
+
+//errRecordNotFound - returned when cloudflare has no record with the given name and type, or no longer knows the record identifier
+var errRecordNotFound = errors.New("dns record not found")
+
+//DNSUpdateRequest - Request sent to create or update an A, AAAA, CNAME, TXT or MX record to Cloud Flare
+//"{\"id\":\"$zone_identifier\",\"type\":\"A\",\"proxied\":${proxy},\"name\":\"$record_name\",\"content\":\"$ip\"})
+type DNSUpdateRequest struct {
+	ZoneIdentifier string   `json:"id"`
+	RecordType     string   `json:"type"`
+	EnableProxy    bool     `json:"proxied"`
+	RecordName     string   `json:"name"`
+	Content        string   `json:"content"`
+	TTL            int      `json:"ttl"`
+	Comment        string   `json:"comment,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
+	//only sent for the types having one (MX)
+	Priority *int `json:"priority,omitempty"`
+}
+
+//DNSPatchRequest - Request sent to update a record with PATCH when updateMethod is patch, holding the content and only the
+//settings the live record doesn't match, so the comment, tags and any other field set elsewhere are kept
+type DNSPatchRequest struct {
+	Content  string `json:"content"`
+	Proxied  *bool  `json:"proxied,omitempty"`
+	TTL      *int   `json:"ttl,omitempty"`
+	Priority *int   `json:"priority,omitempty"`
+}
+
+//cloudflareError - entry of the errors array of a cloudflare api response
+type cloudflareError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+//cloudflareRecord - dns record as returned by the cloudflare api
+type cloudflareRecord struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	Proxied bool   `json:"proxied"`
+	TTL     int    `json:"ttl"`
+	//set for MX records
+	Priority *int `json:"priority"`
+}
+
+//cloudflareResponse - envelope shared by every cloudflare api response.
+//Success is a pointer so a body without it (html, gateway errors) can be told apart from success false.
+type cloudflareResponse struct {
+	Success *bool             `json:"success"`
+	Errors  []cloudflareError `json:"errors"`
+}
+
+//cloudflareResultInfo - paging information of a list response
+type cloudflareResultInfo struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	TotalPages int `json:"total_pages"`
+	Count      int `json:"count"`
+	TotalCount int `json:"total_count"`
+}
+
+//cloudflareListResponse - response of GET /zones/{zone}/dns_records
+type cloudflareListResponse struct {
+	cloudflareResponse
+	Result     []cloudflareRecord   `json:"result"`
+	ResultInfo cloudflareResultInfo `json:"result_info"`
+}
+
+//cloudflareZone - zone as returned by the cloudflare api
+type cloudflareZone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	//permissions of the credentials on the zone, e.g. #dns_records:edit, not every kind of credentials gets them listed
+	Permissions []string `json:"permissions"`
+}
+
+//cloudflareZoneResponse - response of GET /zones/{zone}
+type cloudflareZoneResponse struct {
+	cloudflareResponse
+	Result cloudflareZone `json:"result"`
+}
+
+//cloudflareZoneListResponse - response of GET /zones
+type cloudflareZoneListResponse struct {
+	cloudflareResponse
+	Result []cloudflareZone `json:"result"`
+}
+
+//cloudflareRecordResponse - response of the endpoints creating or updating a single record
+type cloudflareRecordResponse struct {
+	cloudflareResponse
+	Result cloudflareRecord `json:"result"`
+}
+
+//check - returns an error when the response is missing the success flag or reports a failure
+func (response *cloudflareResponse) check(statusCode int) error {
+	if response.Success == nil {
+		return fmt.Errorf("unexpected response (http %d) :- missing success field", statusCode)
+	}
+	if !*response.Success {
+		return fmt.Errorf("server returned error (http %d) :- %s", statusCode, formatCloudflareErrors(response.Errors))
+	}
+	return nil
+}
+
+//unexpectedResponse - error for a response body that couldn't be decoded, telling an empty body (proxies, gateway errors) apart
+func unexpectedResponse(statusCode int, err error) error {
+	if err == io.EOF {
+		return fmt.Errorf("unexpected response (http %d) :- empty body", statusCode)
+	}
+	return fmt.Errorf("unexpected response (http %d) :- %s", statusCode, err.Error())
+}
+
+//formatCloudflareErrors - joins the code and message of every error into a single line
+func formatCloudflareErrors(cloudflareErrors []cloudflareError) string {
+	if len(cloudflareErrors) == 0 {
+		return "no error details"
+	}
+	messages := make([]string, 0, len(cloudflareErrors))
+	for _, cloudflareError := range cloudflareErrors {
+		messages = append(messages, fmt.Sprintf("[%d] %s", cloudflareError.Code, cloudflareError.Message))
+	}
+	return strings.Join(messages, ", ")
+}
+
+//addAuthHeaders - adds the Bearer token header when an api token is configured, otherwise the legacy email + key headers.
+//The credentials of the zone the record was listed under win over the top level ones.
+func addAuthHeaders(request *http.Request, configuration *Configuration, record *RecordConfig) {
+	apiToken, authEmail, authKey := configuration.APIToken, configuration.AuthEmail, configuration.AuthKey
+	if record.hasOwnCredentials() {
+		apiToken, authEmail, authKey = record.apiToken, record.authEmail, record.authKey
+	}
+
+	if apiToken != "" {
+		request.Header.Add("Authorization", "Bearer "+apiToken)
+		return
+	}
+	request.Header.Add("X-Auth-Email", authEmail)
+	request.Header.Add("X-Auth-Key", authKey)
+}
+
+//authRejected - set when cloudflare answers 401 or 403, so main can tell bad credentials apart from other failures
+var authRejected atomic.Bool
+
+//rateLimitedUntil - set when cloudflare answers 429, no api call is made before it
+var rateLimitedUntil time.Time
+var rateLimitMutex sync.Mutex
+
+//waitForRateLimit - blocks until a previous 429 backoff has elapsed or ctx is cancelled
+func waitForRateLimit(ctx context.Context) error {
+	rateLimitMutex.Lock()
+	wait := time.Until(rateLimitedUntil)
+	rateLimitMutex.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	log.Printf("rate limited by cloudflare, waiting %s before the next api call", wait.Round(time.Second))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+//setRateLimited - backs off all api calls for the duration of the Retry-After header (seconds or http date),
+//or fallback when the header is missing or malformed
+func setRateLimited(resp *http.Response, fallback time.Duration) time.Duration {
+	wait := fallback
+	retryAfter := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(retryAfter); err == nil {
+		wait = time.Until(date)
+	}
+
+	rateLimitMutex.Lock()
+	rateLimitedUntil = time.Now().Add(wait)
+	rateLimitMutex.Unlock()
+	return wait
+}
+
+//doWithRetry - sends a cloudflare api request through sendWithRetry, unless the circuit breaker is open after repeated failures
+func (client *cloudflareClient) doWithRetry(ctx context.Context, request *http.Request) (*http.Response, error) {
+	err := cloudflareBreaker.allow(time.Duration(client.configuration.CircuitBreakerCooldownSeconds) * time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.sendWithRetry(ctx, request)
+	//a cancelled check says nothing about cloudflare
+	if ctx.Err() != nil {
+		cloudflareBreaker.release()
+		return resp, err
+	}
+	succeeded := err == nil && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests
+	cloudflareBreaker.record(succeeded, client.configuration.CircuitBreakerFailures)
+	return resp, err
+}
+
+//sendWithRetry - sends a cloudflare api request, retrying network errors, 429 and 5xx responses up to maxRetries times
+//with exponential backoff (retryDelaySeconds, doubled every attempt) plus jitter, or after Retry-After on 429.
+//Any other response, including 4xx like 401/403 which won't succeed on retry, is returned straight away.
+func (client *cloudflareClient) sendWithRetry(ctx context.Context, request *http.Request) (*http.Response, error) {
+	delay := client.retryDelay
+	if delay == 0 {
+		delay = time.Duration(client.configuration.RetryDelaySeconds) * time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && request.GetBody != nil {
+			body, err := request.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			request.Body = body
+		}
+
+		err := waitForRateLimit(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		debugLogRequest(request)
+		resp, err := client.doer.Do(request)
+		if err == nil {
+			debugLogResponse(request, resp)
+		}
+		if err == nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			authRejected.Store(true)
+		}
+		if err == nil && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return resp, nil
+		}
+
+		wait := delay << attempt
+		if delay > 0 {
+			wait += time.Duration(rand.Int63n(int64(delay)))
+		}
+		if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+			wait = setRateLimited(resp, wait)
+			log.Printf("%s %s was rate limited by cloudflare, backing off for %s", request.Method, request.URL.Path, wait.Round(time.Second))
+		}
+		if attempt >= client.configuration.MaxRetries {
+			return resp, err
+		}
+
+		if err != nil {
+			log.Printf("%s %s failed, retrying in %s :- %s", request.Method, request.URL.Path, wait, err.Error())
+		} else {
+			log.Printf("%s %s returned %s, retrying in %s", request.Method, request.URL.Path, resp.Status, wait)
+			resp.Body.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+//debugLogRequest - logs the method, url and body of request at debug level, auth headers are left out
+func debugLogRequest(request *http.Request) {
+	if logLevel.Load() < levelDebug {
+		return
+	}
+	body := ""
+	if request.GetBody != nil {
+		reader, err := request.GetBody()
+		if err == nil {
+			data, _ := io.ReadAll(reader)
+			body = " " + string(data)
+		}
+	}
+	logDebugf("cloudflare request %s %s%s", request.Method, request.URL, body)
+}
+
+//debugLogResponse - logs the status and body of resp at debug level, the body is buffered so it can still be decoded
+func debugLogResponse(request *http.Request, resp *http.Response) {
+	if logLevel.Load() < levelDebug {
+		return
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		logDebugf("cloudflare response %s %s %s, body unreadable :- %s", request.Method, request.URL.Path, resp.Status, err.Error())
+		return
+	}
+	logDebugf("cloudflare response %s %s %s %s", request.Method, request.URL.Path, resp.Status, strings.TrimSpace(string(data)))
+}
+
+//checkResponseStatus - returns an error for non 2xx responses, listing the code and message of every entry
+//of the errors array cloudflare sends back so users can see why the call failed
+func checkResponseStatus(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+
+	var responseJSON cloudflareResponse
+	err := json.NewDecoder(resp.Body).Decode(&responseJSON)
+	if err != nil || len(responseJSON.Errors) == 0 {
+		return fmt.Errorf("cloudflare returned %s", resp.Status)
+	}
+	return fmt.Errorf("cloudflare returned %s :- %s", resp.Status, formatCloudflareErrors(responseJSON.Errors))
+}
+
+//lookupDNSRecord - Get the record of the given record type from Cloudflare by name, including its identifier and current content.
+//The pages of the list are read in turn until the record is found.
+func (client *cloudflareClient) lookupDNSRecord(ctx context.Context, record *RecordConfig, recordType string) (cloudflareRecord, error) {
+	for page := 1; ; page++ {
+		responseJSON, err := client.listDNSRecords(ctx, record, record.RecordName, recordType, page)
+		if err != nil {
+			return cloudflareRecord{}, err
+		}
+
+		liveRecord, found := matchingRecord(responseJSON.Result, record.RecordName, recordType)
+		if found && liveRecord.ID == "" {
+			return cloudflareRecord{}, errors.New("unexpected response :- record has no id")
+		}
+		if found {
+			return liveRecord, nil
+		}
+		//a response without paging information is a single page
+		if len(responseJSON.Result) == 0 || page >= responseJSON.ResultInfo.TotalPages {
+			return cloudflareRecord{}, errRecordNotFound
+		}
+	}
+}
+
+//listZoneRecords - Get every record of the zone of record from Cloudflare, reading all the pages of the list
+func (client *cloudflareClient) listZoneRecords(ctx context.Context, record *RecordConfig) ([]cloudflareRecord, error) {
+	var records []cloudflareRecord
+	for page := 1; ; page++ {
+		responseJSON, err := client.listDNSRecords(ctx, record, "", "", page)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, responseJSON.Result...)
+		if len(responseJSON.Result) == 0 || page >= responseJSON.ResultInfo.TotalPages {
+			return records, nil
+		}
+	}
+}
+
+//listDNSRecords - Get a page of the records of the zone of record from Cloudflare, filtered on recordName and recordType unless they're empty
+func (client *cloudflareClient) listDNSRecords(ctx context.Context, record *RecordConfig, recordName string, recordType string, page int) (cloudflareListResponse, error) {
+	//"https://api.cloudflare.com/client/v4/zones/$zone_identifier/dns_records?name=$record_name&type=$record_type" -H "X-Auth-Email: $auth_email" -H "X-Auth-Key: $auth_key" -H "Content-Type: application/json"
+	query := fmt.Sprintf("page=%d&per_page=%d", page, recordsPerPage)
+	if recordName != "" {
+		query += "&name=" + url.QueryEscape(recordName)
+	}
+	if recordType != "" {
+		query += "&type=" + url.QueryEscape(recordType)
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", client.endpoint(fmt.Sprintf("/zones/%s/dns_records?%s",
+		record.ZoneIdentifier, query)), nil)
+	if err != nil {
+		log.Printf("error when getting dns record identifier :- %s", err.Error())
+		return cloudflareListResponse{}, err
+	}
+
+	addAuthHeaders(request, client.configuration, record)
+	request.Header.Add("Content-Type", "application/json")
+
+	resp, err := client.doWithRetry(ctx, request)
+	if err != nil {
+		log.Printf("error when getting dns record identifier :- %s", err.Error())
+		return cloudflareListResponse{}, err
+	}
+
+	defer resp.Body.Close()
+
+	err = checkResponseStatus(resp)
+	if err != nil {
+		log.Printf("error when getting dns record identifier :- %s", err.Error())
+		return cloudflareListResponse{}, err
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	var responseJSON cloudflareListResponse
+	err = decoder.Decode(&responseJSON)
+
+	if err != nil {
+		log.Printf("error when getting dns record identifier :- %s", err.Error())
+		return cloudflareListResponse{}, unexpectedResponse(resp.StatusCode, err)
+	}
+
+	err = responseJSON.check(resp.StatusCode)
+	if err != nil {
+		return cloudflareListResponse{}, err
+	}
+	return responseJSON, nil
+}
+
+//matchingRecord - first record with the given name and type.
+//The query already filters on both, this is a backstop so an A record is never updated with an ipv6 (or the other way round)
+//should the api ignore a filter.
+func matchingRecord(records []cloudflareRecord, recordName string, recordType string) (cloudflareRecord, bool) {
+	for _, liveRecord := range records {
+		if liveRecord.Type == recordType && strings.EqualFold(strings.TrimSuffix(liveRecord.Name, "."), strings.TrimSuffix(recordName, ".")) {
+			return liveRecord, true
+		}
+	}
+	return cloudflareRecord{}, false
+}
+
+//lookupZoneIdentifier - Get the identifier of the zone the record is in from its name (e.g. example.com) from Cloudflare
+func (client *cloudflareClient) lookupZoneIdentifier(ctx context.Context, record *RecordConfig) (string, error) {
+	zoneName := record.ZoneName
+	request, err := http.NewRequestWithContext(ctx, "GET", client.endpoint("/zones?name="+url.QueryEscape(zoneName)), nil)
+	if err != nil {
+		log.Printf("error when getting zone identifier :- %s", err.Error())
+		return "", err
+	}
+
+	addAuthHeaders(request, client.configuration, record)
+	request.Header.Add("Content-Type", "application/json")
+
+	resp, err := client.doWithRetry(ctx, request)
+	if err != nil {
+		log.Printf("error when getting zone identifier :- %s", err.Error())
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	err = checkResponseStatus(resp)
+	if err != nil {
+		log.Printf("error when getting zone identifier :- %s", err.Error())
+		return "", err
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	var responseJSON cloudflareZoneListResponse
+	err = decoder.Decode(&responseJSON)
+
+	if err != nil {
+		log.Printf("error when getting zone identifier :- %s", err.Error())
+		return "", unexpectedResponse(resp.StatusCode, err)
+	}
+
+	err = responseJSON.check(resp.StatusCode)
+	if err != nil {
+		return "", err
+	}
+	if len(responseJSON.Result) == 0 || responseJSON.Result[0].ID == "" {
+		return "", fmt.Errorf("zone %s not found, check the name and that the credentials can read it", zoneName)
+	}
+	return responseJSON.Result[0].ID, nil
+}
+
+//getZone - Get the zone of the record from Cloudflare, a cheap call telling whether the credentials can access it
+func (client *cloudflareClient) getZone(ctx context.Context, record *RecordConfig) (cloudflareZone, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", client.endpoint(fmt.Sprintf("/zones/%s", record.ZoneIdentifier)), nil)
+	if err != nil {
+		return cloudflareZone{}, err
+	}
+
+	addAuthHeaders(request, client.configuration, record)
+	request.Header.Add("Content-Type", "application/json")
+
+	resp, err := client.doWithRetry(ctx, request)
+	if err != nil {
+		return cloudflareZone{}, err
+	}
+
+	defer resp.Body.Close()
+
+	err = checkResponseStatus(resp)
+	if err != nil {
+		return cloudflareZone{}, err
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	var responseJSON cloudflareZoneResponse
+	err = decoder.Decode(&responseJSON)
+
+	if err != nil {
+		return cloudflareZone{}, unexpectedResponse(resp.StatusCode, err)
+	}
+
+	err = responseJSON.check(resp.StatusCode)
+	if err != nil {
+		return cloudflareZone{}, err
+	}
+	return responseJSON.Result, nil
+}
+
+//getDNSRecord - Get the record with the given identifier from Cloudflare, errRecordNotFound when it no longer exists
+func (client *cloudflareClient) getDNSRecord(ctx context.Context, record *RecordConfig, dnsIdentifier string) (cloudflareRecord, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", client.endpoint(fmt.Sprintf("/zones/%s/dns_records/%s", record.ZoneIdentifier, dnsIdentifier)), nil)
+	if err != nil {
+		log.Printf("error when getting dns record :- %s", err.Error())
+		return cloudflareRecord{}, err
+	}
+
+	addAuthHeaders(request, client.configuration, record)
+	request.Header.Add("Content-Type", "application/json")
+
+	resp, err := client.doWithRetry(ctx, request)
+	if err != nil {
+		log.Printf("error when getting dns record :- %s", err.Error())
+		return cloudflareRecord{}, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return cloudflareRecord{}, errRecordNotFound
+	}
+
+	err = checkResponseStatus(resp)
+	if err != nil {
+		log.Printf("error when getting dns record :- %s", err.Error())
+		return cloudflareRecord{}, err
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	var responseJSON cloudflareRecordResponse
+	err = decoder.Decode(&responseJSON)
+
+	if err != nil {
+		log.Printf("error when getting dns record :- %s", err.Error())
+		return cloudflareRecord{}, unexpectedResponse(resp.StatusCode, err)
+	}
+
+	err = responseJSON.check(resp.StatusCode)
+	if err != nil {
+		return cloudflareRecord{}, err
+	}
+	return responseJSON.Result, nil
+}
+
+//newDNSUpdateRequest - builds the record body sent to cloudflare when creating or updating a record
+func newDNSUpdateRequest(record *RecordConfig, content string, recordType string) DNSUpdateRequest {
+	return DNSUpdateRequest{
+		Content:        content,
+		EnableProxy:    record.proxied(),
+		RecordName:     record.RecordName,
+		RecordType:     recordType,
+		ZoneIdentifier: record.ZoneIdentifier,
+		TTL:            int(record.TTL),
+		Comment:        expandComment(record.Comment, time.Now()),
+		Tags:           record.Tags,
+		Priority:       record.Priority,
+	}
+}
+
+//newDNSPatchRequest - builds the body sent to cloudflare when updating a record with PATCH, see settingsMatch for the settings compared
+func newDNSPatchRequest(liveRecord cloudflareRecord, record *RecordConfig, content string) DNSPatchRequest {
+	body := DNSPatchRequest{Content: content}
+	if liveRecord.Proxied != record.proxied() {
+		proxied := record.proxied()
+		body.Proxied = &proxied
+	}
+	if !record.proxied() && liveRecord.TTL != int(record.TTL) {
+		ttl := int(record.TTL)
+		body.TTL = &ttl
+	}
+	if record.Priority != nil && (liveRecord.Priority == nil || *liveRecord.Priority != *record.Priority) {
+		body.Priority = record.Priority
+	}
+	return body
+}
+
+//expandComment - replaces {time} in the record comment with the time of the update
+func expandComment(comment string, now time.Time) string {
+	return strings.ReplaceAll(comment, "{time}", now.UTC().Format(time.RFC3339))
+}
+
+//sendDNSRecord - sends the record body to cloudflare with method (POST to create, PUT to update) and returns the response.
+//Tags and a comment are optional niceties, when cloudflare rejects the body with 400 (plans without tags,
+//accounts or api versions without comments) the record is sent again without the tags, then without the comment,
+//rather than leaving the record out of date.
+func (client *cloudflareClient) sendDNSRecord(ctx context.Context, method string, requestURL string, record *RecordConfig, body DNSUpdateRequest) (*http.Response, error) {
+	resp, err := client.sendDNSRecordOnce(ctx, method, requestURL, record, body)
+	if err == nil && resp.StatusCode == http.StatusBadRequest && len(body.Tags) > 0 {
+		resp.Body.Close()
+		log.Printf("cloudflare rejected the tags of record=%s type=%s, sending it without tags", record.RecordName, body.RecordType)
+		body.Tags = nil
+		resp, err = client.sendDNSRecordOnce(ctx, method, requestURL, record, body)
+	}
+	if err == nil && resp.StatusCode == http.StatusBadRequest && body.Comment != "" {
+		resp.Body.Close()
+		log.Printf("cloudflare rejected the comment of record=%s type=%s, sending it without the comment", record.RecordName, body.RecordType)
+		body.Comment = ""
+		resp, err = client.sendDNSRecordOnce(ctx, method, requestURL, record, body)
+	}
+	return resp, err
+}
+
+//sendDNSRecordOnce - sends the record body (a DNSUpdateRequest or a DNSPatchRequest) as JSON with the auth headers of the record
+func (client *cloudflareClient) sendDNSRecordOnce(ctx context.Context, method string, requestURL string, record *RecordConfig, body interface{}) (*http.Response, error) {
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, requestURL, bytes.NewBuffer(bodyJSON))
+	if err != nil {
+		return nil, err
+	}
+
+	//add header
+	addAuthHeaders(request, client.configuration, record)
+	request.Header.Add("Content-Type", "application/json")
+
+	return client.doWithRetry(ctx, request)
+}
+
+//createDNSRecord - Creates a new cloudflare dns record with the given content (the current IP for A and AAAA records) and returns its identifier
+func (client *cloudflareClient) createDNSRecord(ctx context.Context, record *RecordConfig, content string, recordType string) (string, error) {
+
+	//create request body
+	var dNSUpdateRequest = newDNSUpdateRequest(record, content, recordType)
+
+	resp, err := client.sendDNSRecord(ctx, "POST", client.endpoint(fmt.Sprintf("/zones/%s/dns_records",
+		record.ZoneIdentifier)), record, dNSUpdateRequest)
+	if err != nil {
+		log.Printf("error when creating dns record :- %s", err.Error())
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	err = checkResponseStatus(resp)
+	if err != nil {
+		log.Printf("error when creating dns record :- %s", err.Error())
+		return "", err
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	var responseJSON cloudflareRecordResponse
+	err = decoder.Decode(&responseJSON)
+
+	if err != nil {
+		log.Printf("error when creating dns record :- %s", err.Error())
+		return "", unexpectedResponse(resp.StatusCode, err)
+	}
+
+	err = responseJSON.check(resp.StatusCode)
+	if err != nil {
+		return "", err
+	}
+	if responseJSON.Result.ID == "" {
+		return "", fmt.Errorf("unexpected response (http %d) :- record has no id", resp.StatusCode)
+	}
+	return responseJSON.Result.ID, nil
+}
+
+//updateCurrentIPToDNS - Updates cloudflare dns record liveRecord to the given content, the current IP for A and AAAA records.
+//The whole record is replaced with PUT, or only the content and the settings that changed are sent with PATCH when updateMethod is patch.
+func (client *cloudflareClient) updateCurrentIPToDNS(ctx context.Context, record *RecordConfig, content string, liveRecord cloudflareRecord, recordType string) error {
+	requestURL := client.endpoint(fmt.Sprintf("/zones/%s/dns_records/%s", record.ZoneIdentifier, liveRecord.ID))
+
+	var resp *http.Response
+	var err error
+	if client.configuration.UpdateMethod == "patch" {
+		resp, err = client.sendDNSRecordOnce(ctx, "PATCH", requestURL, record, newDNSPatchRequest(liveRecord, record, content))
+	} else {
+		resp, err = client.sendDNSRecord(ctx, "PUT", requestURL, record, newDNSUpdateRequest(record, content, recordType))
+	}
+	if err != nil {
+		log.Printf("error when updating dns record :- %s", err.Error())
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errRecordNotFound
+	}
+
+	err = checkResponseStatus(resp)
+	if err != nil {
+		log.Printf("error when updating dns record :- %s", err.Error())
+		return err
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	var responseJSON cloudflareRecordResponse
+	err = decoder.Decode(&responseJSON)
+
+	if err != nil {
+		log.Printf("error when updating dns record :- %s", err.Error())
+		return unexpectedResponse(resp.StatusCode, err)
+	}
+
+	return responseJSON.check(resp.StatusCode)
+}
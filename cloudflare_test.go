@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//testClient - a client of configuration sending its requests to the test server, retrying without waiting
+func testClient(configuration *Configuration, server *httptest.Server) *cloudflareClient {
+	return &cloudflareClient{doer: server.Client(), configuration: configuration, baseURL: server.URL, retryDelay: time.Millisecond}
+}
+
+//stubDoer - answers every request with status and body, remembering the requests
+type stubDoer struct {
+	status   int
+	body     string
+	requests []*http.Request
+}
+
+func (doer *stubDoer) Do(request *http.Request) (*http.Response, error) {
+	doer.requests = append(doer.requests, request)
+	return &http.Response{
+		StatusCode: doer.status,
+		Status:     http.StatusText(doer.status),
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(doer.body)),
+	}, nil
+}
+
+//stubClient - a client of the test configuration answered by doer
+func stubClient(t *testing.T, doer HTTPDoer) *cloudflareClient {
+	resetCheckGlobals(t)
+	configuration := testConfiguration(t, "https://cloudflare.invalid/client/v4")
+	return &cloudflareClient{doer: doer, configuration: configuration, baseURL: configuration.APIBaseURL, retryDelay: time.Millisecond}
+}
+
+func TestLookupDNSRecord(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		wantID    string
+		wantError string
+	}{
+		{
+			name:   "success",
+			status: 200,
+			body: `{"success":true,"errors":[],"result":[{"id":"r1","type":"A","name":"home.example.com","content":"198.51.100.1","proxied":false,"ttl":120}],` +
+				`"result_info":{"page":1,"per_page":100,"total_pages":1,"count":1,"total_count":1}}`,
+			wantID: "r1",
+		},
+		{
+			name:      "empty result",
+			status:    200,
+			body:      `{"success":true,"errors":[],"result":[],"result_info":{"page":1,"per_page":100,"total_pages":0,"count":0,"total_count":0}}`,
+			wantError: "dns record not found",
+		},
+		{
+			name:      "api error",
+			status:    400,
+			body:      `{"success":false,"errors":[{"code":7003,"message":"Could not route to /zones/z1/dns_records, perhaps your object identifier is invalid?"}],"result":null}`,
+			wantError: "[7003] Could not route",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			doer := &stubDoer{status: test.status, body: test.body}
+			client := stubClient(t, doer)
+			record := &client.configuration.Records[0]
+
+			liveRecord, err := client.lookupDNSRecord(context.Background(), record, "A")
+			if test.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantError) {
+					t.Fatalf("lookupDNSRecord() :- %v, want an error containing %q", err, test.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lookupDNSRecord() :- %s", err.Error())
+			}
+			if liveRecord.ID != test.wantID || liveRecord.Content != "198.51.100.1" {
+				t.Errorf("record %+v, want id %s with content 198.51.100.1", liveRecord, test.wantID)
+			}
+			if len(doer.requests) != 1 {
+				t.Fatalf("%d requests sent, want 1", len(doer.requests))
+			}
+			query := doer.requests[0].URL.Query()
+			if doer.requests[0].URL.Path != "/client/v4/zones/z1/dns_records" || query.Get("name") != "home.example.com" || query.Get("type") != "A" {
+				t.Errorf("request sent to %s", doer.requests[0].URL)
+			}
+			if doer.requests[0].Header.Get("Authorization") != "Bearer token" {
+				t.Errorf("authorization header %q", doer.requests[0].Header.Get("Authorization"))
+			}
+		})
+	}
+}
+
+func TestSendWithRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		wantCalls int32
+		want      int
+	}{
+		{name: "server errors then success", statuses: []int{500, 500, 200}, wantCalls: 3, want: 200},
+		{name: "unauthorized isn't retried", statuses: []int{401, 200}, wantCalls: 1, want: 401},
+		{name: "forbidden isn't retried", statuses: []int{403, 200}, wantCalls: 1, want: 403},
+		{name: "gives up after maxRetries", statuses: []int{502, 502, 502, 200}, wantCalls: 3, want: 502},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetCheckGlobals(t)
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				call := calls.Add(1)
+				w.WriteHeader(test.statuses[call-1])
+			}))
+			defer server.Close()
+			configuration := testConfiguration(t, server.URL)
+			configuration.MaxRetries = 2
+			client := testClient(configuration, server)
+
+			request, err := http.NewRequestWithContext(context.Background(), "GET", client.endpoint("/zones"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.sendWithRetry(context.Background(), request)
+			if err != nil {
+				t.Fatalf("sendWithRetry() :- %s", err.Error())
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.want {
+				t.Errorf("status %d, want %d", resp.StatusCode, test.want)
+			}
+			if calls.Load() != test.wantCalls {
+				t.Errorf("%d requests sent, want %d", calls.Load(), test.wantCalls)
+			}
+		})
+	}
+}
+
+//decodeFixture - decodes the captured response testdata/name into response
+func decodeFixture(t *testing.T, name string, response interface{}) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(data, response)
+	if err != nil {
+		t.Fatalf("decoding %s :- %s", name, err.Error())
+	}
+}
+
+func TestDecodeListResponse(t *testing.T) {
+	var response cloudflareListResponse
+	decodeFixture(t, "list_records.json", &response)
+	if err := response.check(200); err != nil {
+		t.Fatalf("check() :- %s", err.Error())
+	}
+	if len(response.Result) != 2 || response.ResultInfo.TotalPages != 1 || response.ResultInfo.TotalCount != 2 {
+		t.Fatalf("%d records, result_info %+v", len(response.Result), response.ResultInfo)
+	}
+	record := response.Result[0]
+	if record.ID != "372e67954025e0ba6aaa6d586b9e0b59" || record.Type != "A" || record.Name != "home.example.com" ||
+		record.Content != "198.51.100.4" || record.Proxied || record.TTL != 120 || record.Priority != nil {
+		t.Errorf("A record decoded as %+v", record)
+	}
+	mx := response.Result[1]
+	if mx.Type != "MX" || mx.Priority == nil || *mx.Priority != 10 {
+		t.Errorf("MX record decoded as %+v", mx)
+	}
+}
+
+func TestDecodeRecordResponse(t *testing.T) {
+	var response cloudflareRecordResponse
+	decodeFixture(t, "record.json", &response)
+	if err := response.check(200); err != nil {
+		t.Fatalf("check() :- %s", err.Error())
+	}
+	if response.Result.ID != "372e67954025e0ba6aaa6d586b9e0b59" || response.Result.Content != "203.0.113.7" ||
+		!response.Result.Proxied || response.Result.TTL != 1 {
+		t.Errorf("record decoded as %+v", response.Result)
+	}
+}
+
+func TestDecodeErrorResponse(t *testing.T) {
+	var response cloudflareRecordResponse
+	decodeFixture(t, "error.json", &response)
+	err := response.check(403)
+	if err == nil {
+		t.Fatal("check() accepted success false")
+	}
+	want := "server returned error (http 403) :- [9109] Invalid access token, [10000] Authentication error"
+	if err.Error() != want {
+		t.Errorf("check() :- %q, want %q", err.Error(), want)
+	}
+}
+
+func TestLookupDNSRecordPages(t *testing.T) {
+	const other = `{"id":"r0","type":"A","name":"other.example.com","content":"198.51.100.9","ttl":120}`
+	const wanted = `{"id":"r2","type":"A","name":"home.example.com","content":"198.51.100.1","ttl":120}`
+	tests := []struct {
+		name      string
+		pages     map[string]string
+		wantID    string
+		wantCalls int
+	}{
+		{
+			name: "record on the second page",
+			pages: map[string]string{
+				"1": `{"success":true,"result":[` + other + `],"result_info":{"page":1,"per_page":1,"total_pages":2,"count":1,"total_count":2}}`,
+				"2": `{"success":true,"result":[` + wanted + `],"result_info":{"page":2,"per_page":1,"total_pages":2,"count":1,"total_count":2}}`,
+			},
+			wantID:    "r2",
+			wantCalls: 2,
+		},
+		{
+			name:      "no result_info, found",
+			pages:     map[string]string{"1": `{"success":true,"result":[` + wanted + `]}`},
+			wantID:    "r2",
+			wantCalls: 1,
+		},
+		{
+			name:      "no result_info, not found",
+			pages:     map[string]string{"1": `{"success":true,"result":[` + other + `]}`, "2": `{"success":true,"result":[` + wanted + `]}`},
+			wantCalls: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var pages []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				page := r.URL.Query().Get("page")
+				pages = append(pages, page)
+				w.Write([]byte(test.pages[page]))
+			}))
+			defer server.Close()
+			resetCheckGlobals(t)
+			configuration := testConfiguration(t, server.URL)
+			client := testClient(configuration, server)
+
+			liveRecord, err := client.lookupDNSRecord(context.Background(), &configuration.Records[0], "A")
+			if len(pages) != test.wantCalls {
+				t.Errorf("pages %q read, want %d", pages, test.wantCalls)
+			}
+			if test.wantID == "" {
+				if err != errRecordNotFound {
+					t.Fatalf("lookupDNSRecord() :- %v, want errRecordNotFound", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lookupDNSRecord() :- %s", err.Error())
+			}
+			if liveRecord.ID != test.wantID {
+				t.Errorf("record %+v, want id %s", liveRecord, test.wantID)
+			}
+		})
+	}
+}
+
+func TestMalformedResponses(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantError string
+	}{
+		{name: "empty body", body: "", wantError: "unexpected response (http 200) :- empty body"},
+		{name: "not json", body: "<html>502 Bad Gateway</html>", wantError: "unexpected response (http 200) :- invalid character"},
+		{name: "missing success", body: `{"result":null}`, wantError: "unexpected response (http 200) :- missing success field"},
+		{
+			name:      "success false",
+			body:      `{"success":false,"errors":[{"code":1004,"message":"DNS Validation Error"}],"result":null}`,
+			wantError: "server returned error (http 200) :- [1004] DNS Validation Error",
+		},
+	}
+	calls := map[string]func(client *cloudflareClient, record *RecordConfig) error{
+		"lookup": func(client *cloudflareClient, record *RecordConfig) error {
+			_, err := client.lookupDNSRecord(context.Background(), record, "A")
+			return err
+		},
+		"update": func(client *cloudflareClient, record *RecordConfig) error {
+			return client.updateCurrentIPToDNS(context.Background(), record, "203.0.113.7", cloudflareRecord{ID: "r1"}, "A")
+		},
+	}
+	for _, test := range tests {
+		for callName, call := range calls {
+			t.Run(callName+" "+test.name, func(t *testing.T) {
+				defer func() {
+					if recovered := recover(); recovered != nil {
+						t.Fatalf("panic :- %v", recovered)
+					}
+				}()
+				client := stubClient(t, &stubDoer{status: 200, body: test.body})
+				err := call(client, &client.configuration.Records[0])
+				if err == nil || !strings.HasPrefix(err.Error(), test.wantError) {
+					t.Errorf("error %v, want one starting with %q", err, test.wantError)
+				}
+			})
+		}
+	}
+}
+
+func TestLookupZoneIdentifierEscapesName(t *testing.T) {
+	doer := &stubDoer{status: 200, body: `{"success":true,"result":[{"id":"z9","name":"example.com"}]}`}
+	client := stubClient(t, doer)
+	record := &RecordConfig{RecordName: "home.example.com", ZoneName: "example.com&status=active"}
+
+	zoneIdentifier, err := client.lookupZoneIdentifier(context.Background(), record)
+	if err != nil {
+		t.Fatalf("lookupZoneIdentifier() :- %s", err.Error())
+	}
+	if zoneIdentifier != "z9" {
+		t.Errorf("zone identifier %s, want z9", zoneIdentifier)
+	}
+	query := doer.requests[0].URL.Query()
+	if len(query) != 1 || query.Get("name") != "example.com&status=active" {
+		t.Errorf("zone looked up with the query %s", doer.requests[0].URL.RawQuery)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+)
+
+//recordTypesOf - the record types kept in sync for the record, A (and AAAA with ipv6) unless its type is set
+func recordTypesOf(configuration *Configuration, record *RecordConfig) []string {
+	if record.RecordType != "" {
+		return []string{record.RecordType}
+	}
+	if configuration.EnableIPv6 {
+		return []string{"A", "AAAA"}
+	}
+	return []string{"A"}
+}
+
+//runListCommand - prints every record of the zones of the configured records, to find the exact name and type to configure.
+//Returns the exit code, non-zero when a zone couldn't be listed.
+func runListCommand(ctx context.Context, configuration *Configuration) int {
+	client := newCloudflareClient(configuration)
+	err := resolveZoneIdentifiers(ctx, client, configuration)
+	if err != nil {
+		log.Println(err.Error())
+		if authRejected.Load() {
+			return exitAuthFailed
+		}
+		return exitCheckFailed
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tTYPE\tNAME\tCONTENT\tPROXIED\tTTL")
+	failed := false
+	listed := map[string]bool{}
+	for i := range configuration.Records {
+		//the first record of each zone carries the credentials of the zone
+		record := &configuration.Records[i]
+		if listed[record.ZoneIdentifier] {
+			continue
+		}
+		listed[record.ZoneIdentifier] = true
+
+		liveRecords, err := client.listZoneRecords(ctx, record)
+		if err != nil {
+			log.Printf("error when listing the records of zone %s :- %s", record.ZoneIdentifier, err.Error())
+			failed = true
+			continue
+		}
+		for _, liveRecord := range liveRecords {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%t\t%d\n", liveRecord.ID, liveRecord.Type, liveRecord.Name, liveRecord.Content, liveRecord.Proxied, liveRecord.TTL)
+		}
+	}
+	table.Flush()
+
+	if failed && authRejected.Load() {
+		return exitAuthFailed
+	}
+	if failed {
+		return exitCheckFailed
+	}
+	return 0
+}
+
+//runStatusCommand - prints the record id and the value currently published in cloudflare for every configured record, without updating anything.
+//Returns the exit code, non-zero when a record couldn't be fetched.
+func runStatusCommand(ctx context.Context, configuration *Configuration) int {
+	client := newCloudflareClient(configuration)
+	err := resolveZoneIdentifiers(ctx, client, configuration)
+	if err != nil {
+		log.Println(err.Error())
+		if authRejected.Load() {
+			return exitAuthFailed
+		}
+		return exitCheckFailed
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tTYPE\tNAME\tCONTENT\tPROXIED\tTTL")
+	failed := false
+	for i := range configuration.Records {
+		record := &configuration.Records[i]
+		for _, recordType := range recordTypesOf(configuration, record) {
+			liveRecord, err := getLiveRecord(ctx, client, record, recordType)
+			if err == errRecordNotFound {
+				fmt.Fprintf(table, "-\t%s\t%s\tnot found\t-\t-\n", recordType, record.RecordName)
+				failed = true
+				continue
+			}
+			if err != nil {
+				log.Printf("error when getting record=%s type=%s :- %s", record.RecordName, recordType, err.Error())
+				failed = true
+				continue
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%t\t%d\n", liveRecord.ID, liveRecord.Type, liveRecord.Name, liveRecord.Content, liveRecord.Proxied, liveRecord.TTL)
+		}
+	}
+	table.Flush()
+
+	if failed && authRejected.Load() {
+		return exitAuthFailed
+	}
+	if failed {
+		return exitCheckFailed
+	}
+	return 0
+}
+
+//runCheckCommand - compares the record published in cloudflare with the content (or detected ip), proxy and ttl of the configuration
+//for every configured record and prints whether each is in sync, without updating anything.
+//Returns the exit code, exitOutOfSync when a record differs and non-zero when a record or ip couldn't be fetched.
+func runCheckCommand(ctx context.Context, configuration *Configuration) int {
+	client := newCloudflareClient(configuration)
+	err := resolveZoneIdentifiers(ctx, client, configuration)
+	if err != nil {
+		log.Println(err.Error())
+		if authRejected.Load() {
+			return exitAuthFailed
+		}
+		return exitCheckFailed
+	}
+
+	//the desired content of the records following the ip is the detected one
+	detectedIPs := map[string]string{}
+	for recordType, detect := range map[string]ipDetector{"A": getCurrentIP, "AAAA": getCurrentIPv6} {
+		if !needsDetectedIP(configuration, recordType) {
+			continue
+		}
+		ip, err := detect(ctx, configuration)
+		if err != nil {
+			log.Printf("error when getting current %s address :- %s", recordType, err.Error())
+			continue
+		}
+		detectedIPs[recordType] = ip
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tTYPE\tLIVE\tDESIRED\tIN SYNC")
+	failed := false
+	outOfSync := false
+	for i := range configuration.Records {
+		record := &configuration.Records[i]
+		for _, recordType := range recordTypesOf(configuration, record) {
+			desired := record.Content
+			if desired == "" && detectedIPs[recordType] != "" {
+				desired, err = record.detectedContent(recordType, detectedIPs[recordType], configuration.IPv6PrefixLength)
+				if err != nil {
+					log.Printf("error when building the content of record=%s type=%s :- %s", record.RecordName, recordType, err.Error())
+				}
+			}
+			desiredColumn := fmt.Sprintf("%s proxied=%t ttl=%d", desired, record.proxied(), record.TTL)
+			if desired == "" {
+				desiredColumn = "unknown"
+				failed = true
+			}
+
+			liveRecord, err := getLiveRecord(ctx, client, record, recordType)
+			if err == errRecordNotFound {
+				fmt.Fprintf(table, "%s\t%s\tnot found\t%s\tno\n", record.RecordName, recordType, desiredColumn)
+				outOfSync = true
+				continue
+			}
+			if err != nil {
+				log.Printf("error when getting record=%s type=%s :- %s", record.RecordName, recordType, err.Error())
+				fmt.Fprintf(table, "%s\t%s\tunknown\t%s\t-\n", record.RecordName, recordType, desiredColumn)
+				failed = true
+				continue
+			}
+
+			inSync := "-"
+			if desired != "" {
+				inSync = "yes"
+				if liveRecord.Content != desired || !settingsMatch(liveRecord, record) {
+					inSync = "no"
+					outOfSync = true
+				}
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s proxied=%t ttl=%d\t%s\t%s\n",
+				record.RecordName, recordType, liveRecord.Content, liveRecord.Proxied, liveRecord.TTL, desiredColumn, inSync)
+		}
+	}
+	table.Flush()
+
+	switch {
+	case failed && authRejected.Load():
+		return exitAuthFailed
+	case failed:
+		return exitCheckFailed
+	case outOfSync:
+		return exitOutOfSync
+	}
+	return 0
+}
+
+//verifyResult - outcome of one preflight check of verifyAuth
+type verifyResult struct {
+	zone   string
+	check  string
+	ok     bool
+	detail string
+}
+
+//dnsEditPermission - permission needed to update the records of a zone
+const dnsEditPermission = "#dns_records:edit"
+
+//verifyAuth - preflight of the configuration against cloudflare without updating anything: for the zone of every record whether
+//the credentials are accepted (GET /zones/{zone}), whether they may edit its dns records and whether the configured records exist
+func verifyAuth(ctx context.Context, configuration *Configuration) []verifyResult {
+	client := newCloudflareClient(configuration)
+	err := resolveZoneIdentifiers(ctx, client, configuration)
+	if err != nil {
+		return []verifyResult{{zone: "-", check: "credentials", detail: err.Error()}}
+	}
+
+	var results []verifyResult
+	//zone names by identifier, the identifier is shown for a zone that couldn't be fetched
+	zoneNames := map[string]string{}
+	for i := range configuration.Records {
+		//the first record of each zone carries the credentials of the zone
+		record := &configuration.Records[i]
+		if _, checked := zoneNames[record.ZoneIdentifier]; checked {
+			continue
+		}
+		zoneNames[record.ZoneIdentifier] = record.ZoneIdentifier
+
+		zone, err := client.getZone(ctx, record)
+		if err != nil {
+			results = append(results, verifyResult{zone: record.ZoneIdentifier, check: "credentials", detail: err.Error()})
+			continue
+		}
+		zoneNames[record.ZoneIdentifier] = zone.Name
+		results = append(results, verifyResult{zone: zone.Name, check: "credentials", ok: true, detail: "zone " + zone.ID + " is accessible"})
+
+		switch {
+		case len(zone.Permissions) == 0:
+			results = append(results, verifyResult{zone: zone.Name, check: "dns edit permission", ok: true, detail: "not listed by cloudflare for these credentials, only an update will tell"})
+		case containsString(zone.Permissions, dnsEditPermission):
+			results = append(results, verifyResult{zone: zone.Name, check: "dns edit permission", ok: true, detail: dnsEditPermission + " granted"})
+		default:
+			results = append(results, verifyResult{zone: zone.Name, check: "dns edit permission", detail: dnsEditPermission + " missing, records can't be updated"})
+		}
+	}
+
+	for i := range configuration.Records {
+		record := &configuration.Records[i]
+		for _, recordType := range recordTypesOf(configuration, record) {
+			check := recordType + " record " + record.RecordName
+			_, err := getLiveRecord(ctx, client, record, recordType)
+			switch {
+			case err == errRecordNotFound && configuration.CreateIfMissing:
+				results = append(results, verifyResult{zone: zoneNames[record.ZoneIdentifier], check: check, ok: true, detail: "missing, created on the first check"})
+			case err == errRecordNotFound:
+				results = append(results, verifyResult{zone: zoneNames[record.ZoneIdentifier], check: check, detail: "not found, create it or set createIfMissing"})
+			case err != nil:
+				results = append(results, verifyResult{zone: zoneNames[record.ZoneIdentifier], check: check, detail: err.Error()})
+			default:
+				results = append(results, verifyResult{zone: zoneNames[record.ZoneIdentifier], check: check, ok: true, detail: "exists"})
+			}
+		}
+	}
+	return results
+}
+
+//containsString - whether values holds value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+//runVerifyCommand - prints the results of verifyAuth.
+//Returns the exit code, non-zero when a check failed.
+func runVerifyCommand(ctx context.Context, configuration *Configuration) int {
+	results := verifyAuth(ctx, configuration)
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ZONE\tCHECK\tOK\tDETAIL")
+	failed := false
+	for _, result := range results {
+		ok := "yes"
+		if !result.ok {
+			ok = "no"
+			failed = true
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", result.zone, result.check, ok, result.detail)
+	}
+	table.Flush()
+
+	if failed && authRejected.Load() {
+		return exitAuthFailed
+	}
+	if failed {
+		return exitCheckFailed
+	}
+	return 0
+}
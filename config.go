@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+//TTL - ttl of a record in seconds, 1 asks cloudflare to pick it automatically.
+//config.json and CF_TTL also accept "auto" for it.
+type TTL int
+
+//ttlAutomatic - the ttl cloudflare takes as automatic
+const ttlAutomatic TTL = 1
+
+//maxTTL - longest ttl cloudflare accepts, one day
+const maxTTL TTL = 86400
+
+//UnmarshalJSON - accepts a number of seconds or "auto"
+func (ttl *TTL) UnmarshalJSON(data []byte) error {
+	var auto string
+	if json.Unmarshal(data, &auto) == nil {
+		parsed, err := parseTTL(auto)
+		if err != nil {
+			return err
+		}
+		*ttl = parsed
+		return nil
+	}
+	var seconds int
+	err := json.Unmarshal(data, &seconds)
+	if err != nil {
+		return fmt.Errorf("ttl must be a number of seconds or \"auto\", got %s", string(data))
+	}
+	*ttl = TTL(seconds)
+	return nil
+}
+
+//parseTTL - parses a number of seconds or "auto"
+func parseTTL(value string) (TTL, error) {
+	if strings.EqualFold(value, "auto") {
+		return ttlAutomatic, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("ttl must be a number of seconds or \"auto\", got %q", value)
+	}
+	return TTL(seconds), nil
+}
+
+//loadConfig - reads the configuration from the json file at path, then overrides every field whose env variable is set.
+//The file is optional so containers can be configured through the environment only.
+func loadConfig(path string) (Configuration, error) {
+	var configuration Configuration
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		log.Printf("%s not found, reading configuration from environment only", path)
+	} else if err != nil {
+		return configuration, fmt.Errorf("error opening %s :- %s", path, err.Error())
+	} else {
+		defer file.Close()
+		if isYAMLFile(path) {
+			err = decodeYAMLConfig(file, &configuration)
+		} else {
+			err = json.NewDecoder(file).Decode(&configuration)
+		}
+		if err != nil {
+			return configuration, fmt.Errorf("error decoding %s :- %s", path, err.Error())
+		}
+	}
+
+	err = applyEnvironment(&configuration)
+	if err != nil {
+		return configuration, err
+	}
+	err = readSecretFiles(&configuration)
+	if err != nil {
+		return configuration, err
+	}
+	return configuration, nil
+}
+
+//readSecretFiles - fills the auth key and api token from the files authKeyFile and apiTokenFile point to (docker or kubernetes secrets)
+func readSecretFiles(configuration *Configuration) error {
+	secrets := []struct {
+		name     string
+		path     string
+		fileName string
+		value    *string
+	}{
+		{"authKey", configuration.AuthKeyFile, "authKeyFile", &configuration.AuthKey},
+		{"apiToken", configuration.APITokenFile, "apiTokenFile", &configuration.APIToken},
+	}
+	for _, secret := range secrets {
+		if secret.path == "" {
+			continue
+		}
+		if *secret.value != "" {
+			return fmt.Errorf("both %s and %s are set, configure only one of them", secret.name, secret.fileName)
+		}
+		content, err := os.ReadFile(secret.path)
+		if err != nil {
+			return fmt.Errorf("error reading %s %s :- %s", secret.fileName, secret.path, err.Error())
+		}
+		*secret.value = strings.TrimSpace(string(content))
+		if *secret.value == "" {
+			return fmt.Errorf("%s %s is empty", secret.fileName, secret.path)
+		}
+	}
+	return nil
+}
+
+//applyEnvironment - sets every Configuration field tagged with env from its environment variable when present.
+//Lists are read as comma separated values.
+func applyEnvironment(configuration *Configuration) error {
+	value := reflect.ValueOf(configuration).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		switch field := value.Field(i).Addr().Interface().(type) {
+		case *string:
+			*field = env
+		case *bool:
+			b, err := strconv.ParseBool(env)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s :- %s", name, err.Error())
+			}
+			*field = b
+		case *int:
+			n, err := strconv.Atoi(env)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s :- %s", name, err.Error())
+			}
+			*field = n
+		case *TTL:
+			ttl, err := parseTTL(env)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s :- %s", name, err.Error())
+			}
+			*field = ttl
+		case *[]string:
+			*field = nil
+			for _, item := range strings.Split(env, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					*field = append(*field, item)
+				}
+			}
+		default:
+			return fmt.Errorf("%s can't be set from the environment", name)
+		}
+	}
+	return nil
+}
+
+//isProxiable - whether cloudflare can proxy records of the type, a record without a type is an A (and AAAA) record
+func isProxiable(recordType string) bool {
+	return recordType == "" || recordType == "A" || recordType == "AAAA" || recordType == "CNAME"
+}
+
+//validateHostSuffix - a hostSuffix is the interface identifier appended to the detected ipv6 prefix,
+//it's only used by records following the ipv6 address and must fit in the bits after the prefix
+func validateHostSuffix(record *RecordConfig, prefixLength int) error {
+	if record.HostSuffix == "" {
+		return nil
+	}
+	if record.Content != "" || (record.RecordType != "" && record.RecordType != "AAAA") {
+		return errors.New("hostSuffix is only used by AAAA records following the detected ipv6 address")
+	}
+	suffix := net.ParseIP(record.HostSuffix)
+	if suffix == nil || strings.Count(record.HostSuffix, ":") < 2 {
+		return fmt.Errorf("hostSuffix %q is not an ipv6 address like ::1 or ::abcd:1234", record.HostSuffix)
+	}
+	if !suffix.Mask(net.CIDRMask(prefixLength, 128)).Equal(net.IPv6zero) {
+		return fmt.Errorf("hostSuffix %s has bits set inside the /%d prefix", record.HostSuffix, prefixLength)
+	}
+	if suffix.Equal(net.IPv6zero) {
+		return errors.New("hostSuffix can't be ::, it's the subnet-router anycast address")
+	}
+	return nil
+}
+
+//validateRecordContent - normalizes the record type and checks the fixed content, if any, matches it
+func validateRecordContent(record *RecordConfig) error {
+	record.RecordType = strings.ToUpper(record.RecordType)
+
+	//source spells out where the content comes from, it's otherwise implied by content being set
+	switch record.Source {
+	case "":
+	case "detected-ipv4", "detected-ipv6":
+		recordType := "A"
+		if record.Source == "detected-ipv6" {
+			recordType = "AAAA"
+		}
+		if record.Content != "" {
+			return fmt.Errorf("content can't be set with source %s", record.Source)
+		}
+		if record.RecordType != "" && record.RecordType != recordType {
+			return fmt.Errorf("source %s needs type %s, got %s", record.Source, recordType, record.RecordType)
+		}
+		record.RecordType = recordType
+	case "literal":
+		if record.Content == "" {
+			return errors.New("content is required with source literal")
+		}
+	default:
+		return fmt.Errorf("source must be detected-ipv4, detected-ipv6 or literal, got %s", record.Source)
+	}
+
+	switch record.RecordType {
+	case "", "A", "AAAA":
+		if record.Content == "" {
+			return nil
+		}
+		if record.RecordType == "" {
+			return errors.New("type is required when content is set")
+		}
+		ip := net.ParseIP(record.Content)
+		if ip == nil {
+			return fmt.Errorf("content %q is not an ip address", record.Content)
+		}
+		isIPv4 := ip.To4() != nil && !strings.Contains(record.Content, ":")
+		if record.RecordType == "A" && !isIPv4 {
+			return fmt.Errorf("content %q is not an ipv4 address", record.Content)
+		}
+		if record.RecordType == "AAAA" && isIPv4 {
+			return fmt.Errorf("content %q is not an ipv6 address", record.Content)
+		}
+	case "CNAME":
+		if !isValidHostname(record.Content) {
+			return fmt.Errorf("content %q is not a valid hostname for a CNAME record", record.Content)
+		}
+	case "TXT":
+		if record.Content == "" {
+			return errors.New("content is required for TXT records")
+		}
+		if len(record.Content) > 2048 {
+			return errors.New("TXT content can't be longer than 2048 characters")
+		}
+	case "MX":
+		//a null MX (".") tells the domain accepts no mail
+		if record.Content != "." && !isValidHostname(record.Content) {
+			return fmt.Errorf("content %q is not a valid mail server hostname for an MX record", record.Content)
+		}
+		if record.Priority == nil {
+			return errors.New("priority is required for MX records")
+		}
+		if *record.Priority < 0 || *record.Priority > 65535 {
+			return fmt.Errorf("priority must be between 0 and 65535, got %d", *record.Priority)
+		}
+	default:
+		return fmt.Errorf("unsupported record type %s, use A, AAAA, CNAME, TXT or MX", record.RecordType)
+	}
+	if record.Priority != nil && record.RecordType != "MX" {
+		return fmt.Errorf("priority is only used by MX records, not %s", record.RecordType)
+	}
+	return nil
+}
+
+//isYAMLFile - whether the configuration file is yaml rather than json, by its extension
+func isYAMLFile(path string) bool {
+	extension := strings.ToLower(filepath.Ext(path))
+	return extension == ".yaml" || extension == ".yml"
+}
+
+//decodeYAMLConfig - decodes a yaml configuration file, the yaml keys are the json ones.
+//The document goes through encoding/json so the json tags and the TTL decoding apply to both formats,
+//unquoted values of string settings are kept as written even when they look like numbers.
+func decodeYAMLConfig(reader io.Reader, configuration *Configuration) error {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	document, err := decodeYAML(data)
+	if err != nil {
+		return err
+	}
+	if _, ok := document.(map[string]interface{}); !ok {
+		return errors.New("the document must be a mapping of settings")
+	}
+	documentJSON, err := json.Marshal(yamlTextForStrings(document, reflect.TypeOf(*configuration)))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(documentJSON, configuration)
+}
+
+//validateURLs - checks every url of the named setting is an absolute http or https url
+func validateURLs(name string, urls []string) error {
+	for _, rawURL := range urls {
+		parsedURL, err := url.Parse(rawURL)
+		if err != nil {
+			return fmt.Errorf("%s :- %s", name, err.Error())
+		}
+		if (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+			return fmt.Errorf("%s :- %q must be an absolute http or https url", name, rawURL)
+		}
+	}
+	return nil
+}
+
+//qualifiedRecordName - the full name of a record configured with its label only, "home" in zone example.com is home.example.com
+//and "@" (or no name) the apex. A name already ending with the zone name, or with a dot, is kept as is.
+func qualifiedRecordName(name string, zoneName string) string {
+	zoneName = strings.TrimSuffix(zoneName, ".")
+	switch {
+	case name == "" || name == "@":
+		return zoneName
+	case strings.HasSuffix(name, "."):
+		return strings.TrimSuffix(name, ".")
+	case strings.EqualFold(name, zoneName) || strings.HasSuffix(strings.ToLower(name), "."+strings.ToLower(zoneName)):
+		return name
+	}
+	return name + "." + zoneName
+}
+
+//isValidRecordName - checks name is a hostname, optionally a wildcard (*.example.com)
+func isValidRecordName(name string) bool {
+	return isValidHostname(strings.TrimPrefix(name, "*."))
+}
+
+//isValidHostname - checks name is a dns hostname made of 1-63 character labels of letters, digits, hyphens and underscores
+func isValidHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigEnvironmentOverridesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{"apiToken":"file-token","zoneIdentifier":"z1","recordName":"file.example.com","intervalSeconds":60,"proxy":true}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CF_RECORD", "env.example.com")
+	t.Setenv("CF_INTERVAL_SECONDS", "120")
+	t.Setenv("CF_PROXY", "false")
+
+	configuration, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig() :- %s", err.Error())
+	}
+	if configuration.RecordName != "env.example.com" || configuration.IntervalSeconds != 120 || configuration.EnableProxy {
+		t.Errorf("environment didn't override the file :- recordName %s, intervalSeconds %d, proxy %t",
+			configuration.RecordName, configuration.IntervalSeconds, configuration.EnableProxy)
+	}
+	if configuration.APIToken != "file-token" || configuration.ZoneIdentifier != "z1" {
+		t.Errorf("settings missing from the environment weren't read from the file :- apiToken %s, zoneIdentifier %s",
+			configuration.APIToken, configuration.ZoneIdentifier)
+	}
+}
+
+func TestLoadConfigEnvironmentOnly(t *testing.T) {
+	t.Setenv("CF_API_TOKEN", "env-token")
+	t.Setenv("CF_ZONE", "z1")
+	t.Setenv("CF_RECORD", "env.example.com")
+	t.Setenv("CF_IP_PROVIDERS", "https://one.example/, https://two.example/")
+
+	configuration, err := loadConfig(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatalf("loadConfig() :- %s", err.Error())
+	}
+	if configuration.APIToken != "env-token" || configuration.ZoneIdentifier != "z1" || configuration.RecordName != "env.example.com" {
+		t.Errorf("configuration not read from the environment :- %+v", configuration)
+	}
+	if len(configuration.IPProviders) != 2 || configuration.IPProviders[1] != "https://two.example/" {
+		t.Errorf("ipProviders %q, want the two comma separated providers", configuration.IPProviders)
+	}
+}
+
+func TestLoadConfigInvalidEnvironment(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{name: "CF_PROXY", value: "maybe"},
+		{name: "CF_INTERVAL_SECONDS", value: "five"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(test.name, test.value)
+			_, err := loadConfig(filepath.Join(t.TempDir(), "missing.json"))
+			if err == nil {
+				t.Fatalf("%s=%s accepted", test.name, test.value)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+//crossCheck - progress of the cross-check of the ip detected for a record type
+type crossCheck struct {
+	checks     int //checks since the last cross-check
+	mismatches int //cross-checks in a row the providers disagreed on
+}
+
+//crossChecks - keyed by record type (A or AAAA), only used by the running check (checks are serialized by checkInProgress
+//and the A and AAAA records are checked one after the other) so it needs no mutex of its own
+var crossChecks = map[string]*crossCheck{}
+
+//holdUntilCrossChecked - with crossCheckProviders (crossCheckIPv6Providers for AAAA) set, asks them for the ip every crossCheckEvery checks,
+//and on every check while they disagree with the detected ip. Once they disagreed on crossCheckMismatches cross-checks in a row the records
+//keep their content until the providers agree again, so a provider returning stale or wrong addresses isn't published.
+//A cross-check provider failing doesn't hold anything back, nor does a check forced by -force or SIGUSR1.
+func holdUntilCrossChecked(ctx context.Context, configuration *Configuration, recordType string, ip string) bool {
+	ipv6 := recordType == "AAAA"
+	providers := configuration.CrossCheckProviders
+	if ipv6 {
+		providers = configuration.CrossCheckIPv6Providers
+	}
+	if len(providers) == 0 {
+		return false
+	}
+
+	progress, found := crossChecks[recordType]
+	if !found {
+		progress = &crossCheck{}
+		crossChecks[recordType] = progress
+	}
+	//the first check is cross-checked too
+	due := progress.checks == 0 || progress.mismatches > 0
+	progress.checks = (progress.checks + 1) % configuration.CrossCheckEvery
+	if !due {
+		return false
+	}
+
+	otherIP, err := getIPFromProviders(ctx, providers, configuration.providerJSONKey(), ipv6)
+	if err != nil {
+		log.Printf("error when cross-checking the %s address :- %s", recordType, err.Error())
+		return false
+	}
+
+	if otherIP == ip {
+		if progress.mismatches > 0 {
+			log.Printf("cross-check providers agree again on the %s address %s", recordType, ip)
+			progress.mismatches = 0
+		}
+		logDebugf("cross-check providers agree on the %s address %s", recordType, ip)
+		return false
+	}
+
+	progress.mismatches++
+	if progress.mismatches < configuration.CrossCheckMismatches {
+		log.Printf("cross-check providers returned the %s address %s instead of %s (%d of %d cross-checks in a row)",
+			recordType, otherIP, ip, progress.mismatches, configuration.CrossCheckMismatches)
+		return false
+	}
+	if configuration.forceUpdate {
+		return false
+	}
+	log.Printf("error when cross-checking the %s address :- the cross-check providers returned %s instead of %s on %d cross-checks in a row, not publishing until they agree",
+		recordType, otherIP, ip, progress.mismatches)
+	events.add("error", "%s address %s not published, the cross-check providers returned %s", recordType, ip, otherIP)
+	return true
+}
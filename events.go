@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//maxEvents - events kept by the event log, the oldest ones are dropped first
+const maxEvents = 50
+
+//event - something the updater did, served on /events
+type event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Message string    `json:"message"`
+}
+
+//eventLog - ring buffer of the last maxEvents events (checks, detected ip changes, updates and errors),
+//to see what happened recently without reading the logs
+type eventLog struct {
+	mutex  sync.Mutex
+	events [maxEvents]event
+	next   int
+	count  int
+}
+
+//events - shared by the checks and the http server
+var events = &eventLog{}
+
+//add - records an event, overwriting the oldest one once the buffer is full
+func (buffer *eventLog) add(eventType string, format string, args ...interface{}) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	buffer.events[buffer.next] = event{Time: time.Now().UTC(), Type: eventType, Message: fmt.Sprintf(format, args...)}
+	buffer.next = (buffer.next + 1) % maxEvents
+	if buffer.count < maxEvents {
+		buffer.count++
+	}
+}
+
+//list - the events from the oldest to the newest
+func (buffer *eventLog) list() []event {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	list := make([]event, 0, buffer.count)
+	for i := 0; i < buffer.count; i++ {
+		list = append(list, buffer.events[(buffer.next-buffer.count+i+maxEvents)%maxEvents])
+	}
+	return list
+}
+
+//eventsHandler - serves the events as a JSON array, the oldest first
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(events.list())
+	if err != nil {
+		log.Printf("error when serving /events :- %s", err.Error())
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//logOutput - console and/or file writer every log line ends up in, the console until setupLogOutput runs
+var logOutput io.Writer
+
+//logFile - the file side of logOutput, nil when logging to stdout only
+var logFile *rotatingFile
+
+//Log levels, a line is written when its level is at most the configured logLevel
+const (
+	levelError = iota
+	levelInfo
+	levelDebug
+)
+
+//logLevel - configured level, changed on reload while other goroutines log
+var logLevel atomic.Int32
+
+func init() {
+	logLevel.Store(levelInfo)
+}
+
+//logDebugf - logs the formatted line with a "debug" prefix, only when logLevel is debug
+func logDebugf(format string, v ...interface{}) {
+	if logLevel.Load() < levelDebug {
+		return
+	}
+	log.Output(2, "debug "+fmt.Sprintf(format, v...))
+}
+
+//heartbeats - when the last heartbeat was logged for each record type, and the unchanged checks since
+var heartbeats = map[string]heartbeat{}
+
+//heartbeatsMutex - ipv4 and ipv6 checks log their own heartbeat
+var heartbeatsMutex sync.Mutex
+
+//heartbeat - last heartbeat logged for a record type
+type heartbeat struct {
+	loggedAt       time.Time
+	unchangedSince int
+}
+
+//logUnchanged - logs a check where the records of the type already pointed at ip.
+//With quietUnchanged it's only logged at debug level, and a heartbeat line at most every heartbeatSeconds tells the daemon is still checking.
+func logUnchanged(configuration *Configuration, recordType string, ip string) {
+	if !configuration.QuietUnchanged {
+		log.Printf("both current and previous %s record addresses are the same, skipping...", recordType)
+		return
+	}
+	logDebugf("both current and previous %s record addresses are the same, skipping...", recordType)
+
+	heartbeatsMutex.Lock()
+	defer heartbeatsMutex.Unlock()
+	last := heartbeats[recordType]
+	last.unchangedSince++
+	if time.Since(last.loggedAt) < time.Duration(configuration.HeartbeatSeconds)*time.Second {
+		heartbeats[recordType] = last
+		return
+	}
+	log.Printf("%s records still point at %s, %d unchanged checks since the last heartbeat", recordType, ip, last.unchangedSince)
+	heartbeats[recordType] = heartbeat{loggedAt: time.Now()}
+}
+
+//lineLevel - level of a log message, "error" and "debug" prefixed lines have that level and every other line is info
+func lineLevel(message string) int32 {
+	switch {
+	case strings.HasPrefix(message, "error"):
+		return levelError
+	case strings.HasPrefix(message, "debug "):
+		return levelDebug
+	default:
+		return levelInfo
+	}
+}
+
+//levelFilterWriter - drops the lines above logLevel, so the existing log.Printf calls don't need to know about levels
+type levelFilterWriter struct {
+	out io.Writer
+}
+
+//Write - expects a single log line, the message is taken after the caller of the log.Lshortfile flag
+func (w *levelFilterWriter) Write(p []byte) (int, error) {
+	message := string(p)
+	if i := strings.Index(message, ".go:"); i >= 0 {
+		if j := strings.Index(message[i:], ": "); j >= 0 {
+			message = message[i+j+2:]
+		}
+	}
+	if lineLevel(message) > logLevel.Load() {
+		return len(p), nil
+	}
+	return w.out.Write(p)
+}
+
+//rotatingFile - log file moved to path.1 (path.1 to path.2 and so on) once it would grow past maxSize bytes, keeping maxFiles old files.
+//A maxSize of 0 never rotates.
+type rotatingFile struct {
+	mutex    sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+//openRotatingFile - opens path for appending, rotation limits can be changed later with setLimits
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	rotating := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	err := rotating.open()
+	if err != nil {
+		return nil, err
+	}
+	return rotating, nil
+}
+
+//open - opens the file at path for appending and takes its current size
+func (rotating *rotatingFile) open() error {
+	file, err := os.OpenFile(rotating.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rotating.file = file
+	rotating.size = info.Size()
+	return nil
+}
+
+//setLimits - applies the configured rotation limits
+func (rotating *rotatingFile) setLimits(maxSize int64, maxFiles int) {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+	rotating.maxSize = maxSize
+	rotating.maxFiles = maxFiles
+}
+
+//Write - appends p, rotating first when it would make the file larger than maxSize
+func (rotating *rotatingFile) Write(p []byte) (int, error) {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+
+	if rotating.maxSize > 0 && rotating.size > 0 && rotating.size+int64(len(p)) > rotating.maxSize {
+		err := rotating.rotate()
+		if err != nil {
+			//keep logging to the stdout side of the multi writer, the error can't be logged without recursing here
+			fmt.Fprintf(os.Stderr, "error when rotating %s :- %s\n", rotating.path, err.Error())
+		}
+	}
+	if rotating.file == nil {
+		return len(p), nil
+	}
+	n, err := rotating.file.Write(p)
+	rotating.size += int64(n)
+	return n, err
+}
+
+//rotate - shifts the old files by one, dropping the oldest, and starts a new empty file at path
+func (rotating *rotatingFile) rotate() error {
+	rotating.file.Close()
+	rotating.file = nil
+
+	os.Remove(fmt.Sprintf("%s.%d", rotating.path, rotating.maxFiles))
+	for i := rotating.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rotating.path, i), fmt.Sprintf("%s.%d", rotating.path, i+1))
+	}
+	var err error
+	if rotating.maxFiles > 0 {
+		err = os.Rename(rotating.path, rotating.path+".1")
+	} else {
+		err = os.Remove(rotating.path)
+	}
+	if err != nil {
+		//reopening appends to the current file, it is rotated again on the next write
+		rotating.open()
+		return err
+	}
+	return rotating.open()
+}
+
+//setupLogOutput - sends the logs to stdout, the rotated logFile or both as set by logDestination.
+//Called once the configuration is read, lines logged before only go to stdout.
+func setupLogOutput(configuration *Configuration) error {
+	if configuration.LogDestination == "stdout" {
+		return nil
+	}
+
+	file, err := openRotatingFile(configuration.LogFile, int64(configuration.LogMaxSizeMB)*1024*1024, configuration.LogMaxFiles)
+	if err != nil {
+		return err
+	}
+	logFile = file
+	logOutput = file
+	if configuration.LogDestination == "both" {
+		logOutput = io.MultiWriter(os.Stdout, file)
+	}
+	log.SetOutput(logOutput)
+	return nil
+}
+
+//setupLogRotation - applies logMaxSizeMB and logMaxFiles to the log file, when reloading the configuration
+func setupLogRotation(configuration *Configuration) {
+	if logFile != nil {
+		logFile.setLimits(int64(configuration.LogMaxSizeMB)*1024*1024, configuration.LogMaxFiles)
+	}
+}
+
+//jsonLogWriter - turns each line written by the log package into a JSON object.
+//The level is "error" or "debug" for lines starting with it, "info" otherwise, and key=value pairs in the message
+//(before any " :- " error detail) are added as fields.
+type jsonLogWriter struct {
+	out io.Writer
+}
+
+//Write - expects a single log line prefixed with the caller, as produced with the log.Lshortfile flag
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+
+	entry := map[string]string{}
+	if i := strings.Index(line, ": "); i > 0 && !strings.Contains(line[:i], " ") {
+		entry["caller"] = line[:i]
+		line = line[i+2:]
+	}
+	context := line
+	if i := strings.Index(context, " :- "); i >= 0 {
+		context = context[:i]
+	}
+	for _, field := range strings.Fields(context) {
+		if i := strings.Index(field, "="); i > 0 && isContextKey(field[:i]) {
+			entry[field[:i]] = field[i+1:]
+		}
+	}
+
+	entry["timestamp"] = time.Now().UTC().Format(time.RFC3339)
+	switch lineLevel(line) {
+	case levelError:
+		entry["level"] = "error"
+	case levelDebug:
+		entry["level"] = "debug"
+		line = strings.TrimPrefix(line, "debug ")
+	default:
+		entry["level"] = "info"
+	}
+	entry["message"] = line
+
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.out.Write(append(entryJSON, '\n'))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+//isContextKey - only plain alphanumeric keys are taken as fields, and never one of the fixed ones
+func isContextKey(key string) bool {
+	if key == "caller" || key == "level" || key == "message" || key == "timestamp" {
+		return false
+	}
+	for _, c := range key {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+//setupLogFormat - switches the logger to JSON lines when logFormat is "json", text is kept otherwise.
+//Either way lines are filtered by logLevel.
+func setupLogFormat(configuration *Configuration) {
+	if configuration.LogFormat != "json" {
+		log.SetOutput(&levelFilterWriter{out: logOutput})
+		return
+	}
+	log.SetPrefix("")
+	log.SetFlags(log.Lshortfile)
+	log.SetOutput(&levelFilterWriter{out: &jsonLogWriter{out: logOutput}})
+}
+
+//setupLogLevel - applies logLevel, info when unset
+func setupLogLevel(configuration *Configuration) {
+	switch configuration.LogLevel {
+	case "error":
+		logLevel.Store(levelError)
+	case "debug":
+		logLevel.Store(levelDebug)
+	default:
+		logLevel.Store(levelInfo)
+	}
+}
@@ -1,288 +1,1807 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
-//Configuration - Connection and Record data taken from config.json
+//Exit codes of the script, so wrappers and scripts can tell why it stopped
+const (
+	exitCheckFailed     = 1 //-once check failed
+	exitConfigNotFound  = 2 //no config.json (or config.yaml) and the environment doesn't hold a complete configuration either
+	exitConfigLoad      = 3 //the configuration file or an environment variable couldn't be read or decoded
+	exitConfigInvalid   = 4 //configuration failed validation
+	exitAuthFailed      = 5 //cloudflare rejected the credentials on the first check
+	exitUsage           = 6 //unknown command
+	exitTooManyFailures = 7 //maxConsecutiveFailures checks failed in a row
+	exitOutOfSync       = 8 //the check command found records not matching the configuration
+)
+
+//Errors wrapped by readConfiguration, mapped to the exit codes above by exitCodeFor
+var (
+	errConfigNotFound = errors.New("no config.json or config.yaml found and the environment configuration is incomplete")
+	errConfigLoad     = errors.New("error loading configuration")
+	errConfigInvalid  = errors.New("error in the configuration")
+)
+
+//Configuration - Connection and Record data taken from config.json, overridden by the CF_* environment variables in the env tags
 type Configuration struct {
-	AuthEmail      string `json:"authEmail"`
-	AuthKey        string `json:"authKey"`
-	ZoneIdentifier string `json:"zoneIdentifier"`
-	RecordName     string `json:"recordName"`
-	EnableProxy    bool   `json:"proxy"`
+	AuthEmail                     string             `json:"authEmail" env:"CF_AUTH_EMAIL"`
+	AuthKey                       string             `json:"authKey" env:"CF_AUTH_KEY"`
+	AuthKeyFile                   string             `json:"authKeyFile" env:"CF_AUTH_KEY_FILE"`
+	APIToken                      string             `json:"apiToken" env:"CF_API_TOKEN"`
+	APITokenFile                  string             `json:"apiTokenFile" env:"CF_API_TOKEN_FILE"`
+	APIBaseURL                    string             `json:"apiBaseURL" env:"CF_API_BASE_URL"`
+	ZoneIdentifier                string             `json:"zoneIdentifier" env:"CF_ZONE"`
+	ZoneName                      string             `json:"zoneName" env:"CF_ZONE_NAME"`
+	RecordName                    string             `json:"recordName" env:"CF_RECORD"`
+	EnableProxy                   bool               `json:"proxy" env:"CF_PROXY"`
+	EnableIPv6                    bool               `json:"ipv6" env:"CF_IPV6"`
+	IPv6PrefixLength              int                `json:"ipv6PrefixLength" env:"CF_IPV6_PREFIX_LENGTH"`
+	IntervalSeconds               int                `json:"intervalSeconds" env:"CF_INTERVAL_SECONDS"`
+	IPv6IntervalSeconds           int                `json:"ipv6IntervalSeconds" env:"CF_IPV6_INTERVAL_SECONDS"`
+	IntervalJitterPercent         int                `json:"intervalJitterPercent" env:"CF_INTERVAL_JITTER_PERCENT"`
+	CheckTimeoutSeconds           int                `json:"checkTimeoutSeconds" env:"CF_CHECK_TIMEOUT_SECONDS"`
+	StabilizeDelaySeconds         int                `json:"stabilizeDelaySeconds" env:"CF_STABILIZE_DELAY_SECONDS"`
+	StableChecks                  int                `json:"stableChecks" env:"CF_STABLE_CHECKS"`
+	TTL                           TTL                `json:"ttl" env:"CF_TTL"`
+	RecordComment                 string             `json:"recordComment" env:"CF_RECORD_COMMENT"`
+	RecordTags                    []string           `json:"recordTags" env:"CF_RECORD_TAGS"`
+	HTTPTimeoutSeconds            int                `json:"httpTimeoutSeconds" env:"CF_HTTP_TIMEOUT_SECONDS"`
+	MaxRetries                    int                `json:"maxRetries" env:"CF_MAX_RETRIES"`
+	RetryDelaySeconds             int                `json:"retryDelaySeconds" env:"CF_RETRY_DELAY_SECONDS"`
+	CircuitBreakerFailures        int                `json:"circuitBreakerFailures" env:"CF_CIRCUIT_BREAKER_FAILURES"`
+	CircuitBreakerCooldownSeconds int                `json:"circuitBreakerCooldownSeconds" env:"CF_CIRCUIT_BREAKER_COOLDOWN_SECONDS"`
+	MaxConsecutiveFailures        int                `json:"maxConsecutiveFailures" env:"CF_MAX_CONSECUTIVE_FAILURES"`
+	ShutdownTimeoutSeconds        int                `json:"shutdownTimeoutSeconds" env:"CF_SHUTDOWN_TIMEOUT_SECONDS"`
+	Concurrency                   int                `json:"concurrency" env:"CF_CONCURRENCY"`
+	CreateIfMissing               bool               `json:"createIfMissing" env:"CF_CREATE_IF_MISSING"`
+	DryRun                        bool               `json:"dryRun" env:"CF_DRY_RUN"`
+	UpdateMethod                  string             `json:"updateMethod" env:"CF_UPDATE_METHOD"`
+	IPProviders                   []string           `json:"ipProviders" env:"CF_IP_PROVIDERS"`
+	IPv6Providers                 []string           `json:"ipv6Providers" env:"CF_IPV6_PROVIDERS"`
+	CrossCheckProviders           []string           `json:"crossCheckProviders" env:"CF_CROSS_CHECK_PROVIDERS"`
+	CrossCheckIPv6Providers       []string           `json:"crossCheckIPv6Providers" env:"CF_CROSS_CHECK_IPV6_PROVIDERS"`
+	CrossCheckEvery               int                `json:"crossCheckEvery" env:"CF_CROSS_CHECK_EVERY"`
+	CrossCheckMismatches          int                `json:"crossCheckMismatches" env:"CF_CROSS_CHECK_MISMATCHES"`
+	IPProviderFormat              string             `json:"ipProviderFormat" env:"CF_IP_PROVIDER_FORMAT"`
+	IPProviderJSONKey             string             `json:"ipProviderJsonKey" env:"CF_IP_PROVIDER_JSON_KEY"`
+	IPSource                      string             `json:"ipSource" env:"CF_IP_SOURCE"`
+	IPInterface                   string             `json:"ipInterface" env:"CF_IP_INTERFACE"`
+	IPSourceAddress               string             `json:"ipSourceAddress" env:"CF_IP_SOURCE_ADDRESS"`
+	STUNServer                    string             `json:"stunServer" env:"CF_STUN_SERVER"`
+	AllowPrivateIP                bool               `json:"allowPrivateIP" env:"CF_ALLOW_PRIVATE_IP"`
+	StateFile                     string             `json:"stateFile" env:"CF_STATE_FILE"`
+	ListenAddress                 string             `json:"listenAddress" env:"CF_LISTEN_ADDRESS"`
+	HealthThresholdSeconds        int                `json:"healthThresholdSeconds" env:"CF_HEALTH_THRESHOLD_SECONDS"`
+	NotifyWebhookURL              string             `json:"notifyWebhookURL" env:"CF_NOTIFY_WEBHOOK_URL"`
+	DiscordWebhookURL             string             `json:"discordWebhookURL" env:"CF_DISCORD_WEBHOOK_URL"`
+	SlackWebhookURL               string             `json:"slackWebhookURL" env:"CF_SLACK_WEBHOOK_URL"`
+	TelegramBotToken              string             `json:"telegramBotToken" env:"CF_TELEGRAM_BOT_TOKEN"`
+	TelegramChatID                string             `json:"telegramChatID" env:"CF_TELEGRAM_CHAT_ID"`
+	SMTPHost                      string             `json:"smtpHost" env:"CF_SMTP_HOST"`
+	SMTPPort                      int                `json:"smtpPort" env:"CF_SMTP_PORT"`
+	SMTPUsername                  string             `json:"smtpUsername" env:"CF_SMTP_USERNAME"`
+	SMTPPassword                  string             `json:"smtpPassword" env:"CF_SMTP_PASSWORD"`
+	SMTPFrom                      string             `json:"smtpFrom" env:"CF_SMTP_FROM"`
+	SMTPTo                        []string           `json:"smtpTo" env:"CF_SMTP_TO"`
+	LogFormat                     string             `json:"logFormat" env:"CF_LOG_FORMAT"`
+	LogLevel                      string             `json:"logLevel" env:"CF_LOG_LEVEL"`
+	LogDestination                string             `json:"logDestination" env:"CF_LOG_DESTINATION"`
+	LogFile                       string             `json:"logFile" env:"CF_LOG_FILE"`
+	LogMaxSizeMB                  int                `json:"logMaxSizeMB" env:"CF_LOG_MAX_SIZE_MB"`
+	LogMaxFiles                   int                `json:"logMaxFiles" env:"CF_LOG_MAX_FILES"`
+	QuietUnchanged                bool               `json:"quietUnchanged" env:"CF_QUIET_UNCHANGED"`
+	HeartbeatSeconds              int                `json:"heartbeatSeconds" env:"CF_HEARTBEAT_SECONDS"`
+	UserAgent                     string             `json:"userAgent" env:"CF_USER_AGENT"`
+	ProxyURL                      string             `json:"proxyURL" env:"CF_PROXY_URL"`
+	VerifyRecords                 bool               `json:"verifyRecords" env:"CF_VERIFY_RECORDS"`
+	RecordCacheTTLSeconds         int                `json:"recordCacheTTLSeconds" env:"CF_RECORD_CACHE_TTL_SECONDS"`
+	MaintenanceWindow             *MaintenanceWindow `json:"maintenanceWindow"`
+	Records                       []RecordConfig     `json:"records"`
+	Zones                         []ZoneConfig       `json:"zones"`
+
+	//set for a check forced by -force or SIGUSR1, records are pushed even when they look up to date
+	forceUpdate bool
+	//limits a check to the records of one family when ipv6 has its own interval, see checkSchedule
+	checkFamily string
+}
+
+//ZoneConfig - A zone with its own records, and optionally its own credentials instead of the top level ones.
+//Its records are added to Configuration.Records when the config is validated.
+type ZoneConfig struct {
+	ZoneIdentifier string         `json:"zoneIdentifier"`
+	ZoneName       string         `json:"zoneName"`
+	APIToken       string         `json:"apiToken"`
+	AuthEmail      string         `json:"authEmail"`
+	AuthKey        string         `json:"authKey"`
+	Records        []RecordConfig `json:"records"`
+}
+
+//RecordConfig - A dns record to keep in sync.
+//Without a content the record follows the current public IP, as an A record (plus AAAA when ipv6 is enabled) unless type is set.
+//CNAME, TXT and MX records, or A/AAAA records with a content, are kept pointed at that fixed content.
+//Zone, proxy and TTL fall back to the top level configuration when unset.
+type RecordConfig struct {
+	RecordName     string   `json:"name"`
+	ZoneIdentifier string   `json:"zoneIdentifier"`
+	ZoneName       string   `json:"zoneName"`
+	EnableProxy    *bool    `json:"proxy"`
+	TTL            TTL      `json:"ttl"`
+	RecordType     string   `json:"type"`
+	Source         string   `json:"source"`
+	Content        string   `json:"content"`
+	Comment        string   `json:"comment"`
+	Tags           []string `json:"tags"`
+	HostSuffix     string   `json:"hostSuffix"`
+	Priority       *int     `json:"priority"`
+
+	//credentials of the zone the record was listed under, the top level ones are used when empty
+	apiToken  string
+	authEmail string
+	authKey   string
+}
+
+//proxied - whether the record should be proxied by cloudflare, the pointer is filled from the top level proxy when the config is validated
+func (record *RecordConfig) proxied() bool {
+	return record.EnableProxy != nil && *record.EnableProxy
+}
+
+//priority - priority of an MX record, 0 for the other types which have none
+func (record *RecordConfig) priority() int {
+	if record.Priority == nil {
+		return 0
+	}
+	return *record.Priority
 }
 
-//DNSUpdateRequest - Request sent to update A record to Cloud Flare
-//"{\"id\":\"$zone_identifier\",\"type\":\"A\",\"proxied\":${proxy},\"name\":\"$record_name\",\"content\":\"$ip\"})
-type DNSUpdateRequest struct {
-	ZoneIdentifier string `json:"id"`
-	RecordType     string `json:"type"`
-	EnableProxy    bool   `json:"proxied"`
-	RecordName     string `json:"name"`
-	IPAddress      string `json:"content"`
-	TTL            int16  `json:"ttl"`
+//followsDetectedIP - whether the record should be pointed at the detected ip of the given record type (A or AAAA),
+//a record without a type follows the ipv4 address, and the ipv6 one too when ipv6 is set
+func (record *RecordConfig) followsDetectedIP(recordType string, ipv6 bool) bool {
+	if record.Content != "" {
+		return false
+	}
+	if record.RecordType == "" {
+		return recordType == "A" || (recordType == "AAAA" && ipv6)
+	}
+	return record.RecordType == recordType
+}
+
+//detectedContent - content of a record following the detected ip, an AAAA record with a hostSuffix gets the detected prefix combined with it
+func (record *RecordConfig) detectedContent(recordType string, detectedIP string, prefixLength int) (string, error) {
+	if recordType != "AAAA" || record.HostSuffix == "" {
+		return detectedIP, nil
+	}
+	return combineIPv6Prefix(detectedIP, record.HostSuffix, prefixLength)
+}
+
+//combineIPv6Prefix - the first prefixLength bits of ip (the delegated prefix) followed by the remaining bits of suffix (the interface identifier)
+func combineIPv6Prefix(ip string, suffix string, prefixLength int) (string, error) {
+	prefix := net.ParseIP(ip)
+	if prefix == nil || prefix.To4() != nil {
+		return "", fmt.Errorf("%s is not an ipv6 address", ip)
+	}
+	host := net.ParseIP(suffix)
+	mask := net.CIDRMask(prefixLength, 128)
+	combined := make(net.IP, net.IPv6len)
+	for i := range combined {
+		combined[i] = prefix[i]&mask[i] | host[i]&^mask[i]
+	}
+	if !combined.IsGlobalUnicast() || combined.IsPrivate() {
+		return "", fmt.Errorf("%s combined with the /%d prefix of %s isn't a public ipv6 address", suffix, prefixLength, ip)
+	}
+	return combined.String(), nil
+}
+
+//needsDetectedIP - whether a record follows the detected ip of the record type, so no ip is detected for nothing
+func needsDetectedIP(configuration *Configuration, recordType string) bool {
+	for i := range configuration.Records {
+		if configuration.Records[i].followsDetectedIP(recordType, configuration.EnableIPv6) {
+			return true
+		}
+	}
+	return false
+}
+
+const defaultIntervalSeconds = 300
+const defaultTTL = 120
+const defaultHTTPTimeoutSeconds = 10
+const defaultRetryDelaySeconds = 1
+const defaultShutdownTimeoutSeconds = 30
+const defaultConcurrency = 4
+const defaultIPv6PrefixLength = 64
+const defaultStableChecks = 1
+const defaultCrossCheckEvery = 10
+const defaultCrossCheckMismatches = 3
+const defaultHeartbeatSeconds = 3600
+const defaultRecordCacheTTLSeconds = 3600
+const defaultCircuitBreakerFailures = 5
+const defaultCircuitBreakerCooldownSeconds = 300
+const defaultStateFile = "state.json"
+const defaultSMTPPort = 587
+const defaultLogFile = "ddns.log"
+const defaultLogMaxSizeMB = 10
+const defaultLogMaxFiles = 3
+const defaultIPProviderJSONKey = "ip"
+
+//failedChecksBeforeNotifying - checks failing in a row before the error notifiers are told, so a single transient failure isn't reported
+const failedChecksBeforeNotifying = 3
+
+//defaultIPProviders - ip providers tried in order when ipProviders isn't set
+var defaultIPProviders = []string{"https://ipv4.icanhazip.com/", "https://api.ipify.org/", "https://ifconfig.me/ip"}
+
+//defaultIPv6Providers - ipv6 providers tried in order when ipv6Providers isn't set
+var defaultIPv6Providers = []string{"https://ipv6.icanhazip.com/", "https://api6.ipify.org/"}
+
+//cachedRecord - record identifier resolved from cloudflare, and when
+type cachedRecord struct {
+	id       string
+	cachedAt time.Time
+}
+
+//recordIdentifiers - record identifiers already resolved from cloudflare, keyed by zone, name and type
+var recordIdentifiers = map[string]cachedRecord{}
+var recordIdentifiersMutex sync.Mutex
+
+//zoneIdentifiers - zone identifiers already resolved from cloudflare, keyed by zone name
+var zoneIdentifiers = map[string]string{}
+
+//httpClient - shared client used for every outbound request so a stalled connection can't hang the updater
+var httpClient = &http.Client{Timeout: defaultHTTPTimeoutSeconds * time.Second}
+
+//ipv4ProviderClient, ipv6ProviderClient - clients asking the ip providers, httpClient unless ipSourceAddress is set
+var ipv4ProviderClient = httpClient
+var ipv6ProviderClient = httpClient
+
+//Build info, set at build time with
+//go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+//userAgentTransport - sets the configured User-Agent on every request sent through httpClient
+type userAgentTransport struct {
+	userAgent string
+	base      http.RoundTripper
+}
+
+//RoundTrip - sends a copy of the request with the User-Agent header set, requests must not be modified by a RoundTripper
+func (transport *userAgentTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.Header.Set("User-Agent", transport.userAgent)
+	return transport.base.RoundTrip(request)
+}
+
+//newTransport - a transport like http.DefaultTransport, which honours HTTP_PROXY, HTTPS_PROXY and NO_PROXY,
+//sending every request through proxyURL instead when it's set
+func newTransport(configuration *Configuration) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if configuration.ProxyURL != "" {
+		//validated with the configuration
+		proxyURL, _ := url.Parse(configuration.ProxyURL)
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return transport
+}
+
+//newIPProviderClient - a client sending the requests to the ip providers from the ipSourceAddress of the family,
+//so a multi-homed host detects the ip of the intended uplink. Other settings are the ones of httpClient.
+func newIPProviderClient(configuration *Configuration, ipv6 bool) *http.Client {
+	network := "tcp4"
+	if ipv6 {
+		network = "tcp6"
+	}
+	dialContext := func(ctx context.Context, _ string, address string) (net.Conn, error) {
+		//the address of an interface is looked up on every connection as it may change (dhcp, pppoe reconnects)
+		localIP, err := sourceAddress(configuration.IPSourceAddress, ipv6)
+		if err != nil {
+			return nil, err
+		}
+		dialer := &net.Dialer{Timeout: httpClient.Timeout, LocalAddr: &net.TCPAddr{IP: localIP}}
+		return dialer.DialContext(ctx, network, address)
+	}
+	transport := newTransport(configuration)
+	transport.DialContext = dialContext
+	return &http.Client{
+		Timeout:   httpClient.Timeout,
+		Transport: &userAgentTransport{userAgent: configuration.UserAgent, base: transport},
+	}
+}
+
+//sourceAddress - source is an ip address, or the name of a network interface whose first address of the family is used
+func sourceAddress(source string, ipv6 bool) (net.IP, error) {
+	ip := net.ParseIP(source)
+	if ip != nil {
+		if (ip.To4() == nil) != ipv6 {
+			return nil, fmt.Errorf("ipSourceAddress %s can't be used to reach the ip providers of the other family", source)
+		}
+		return ip, nil
+	}
+
+	networkInterface, err := net.InterfaceByName(source)
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := networkInterface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range addresses {
+		ipNet, ok := address.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() || ipNet.IP.IsLoopback() {
+			continue
+		}
+		if (ipNet.IP.To4() == nil) == ipv6 {
+			return ipNet.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no address of the family to send from", source)
 }
 
-//getCurrentIP - Gets the current Public IPv4 address from ipv4.icanhazip.com
-func getCurrentIP() (string, error) {
+//getIPFromProvider - Gets the current Public IP address from a single ip provider url.
+//The response body (or the value at jsonKey of a JSON body when jsonKey is set) must be a valid IPv4 (or IPv6 when ipv6 is set) address,
+//so an html error page is never pushed to dns.
+func getIPFromProvider(ctx context.Context, providerURL string, jsonKey string, ipv6 bool) (string, error) {
 
-	resp, err := http.Get("https://ipv4.icanhazip.com/")
+	request, err := http.NewRequestWithContext(ctx, "GET", providerURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	client := ipv4ProviderClient
+	if ipv6 {
+		client = ipv6ProviderClient
+	}
+	resp, err := client.Do(request)
 
 	if err != nil {
-		log.Printf("error when getting current ip :- %s", err.Error())
 		return "", err
 	}
 	defer resp.Body.Close()
 
+	//some providers send their ip along with an error status when rate limiting, don't trust it
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", providerURL, resp.Status)
+	}
+
 	body, err := ioutil.ReadAll(resp.Body)
 
 	if err != nil {
-		log.Printf("error when getting current ip :- %s", err.Error())
 		return "", err
 	}
 
-	return string(body), nil
+	if jsonKey != "" {
+		body, err = jsonKeyValue(body, jsonKey)
+		if err != nil {
+			return "", fmt.Errorf("unexpected response from %s :- %s", providerURL, err.Error())
+		}
+	}
+
+	ip := strings.TrimSpace(string(body))
+	if len(ip) > 64 {
+		ip = ip[:64] + "..."
+	}
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return "", fmt.Errorf("response from %s is not an ip address :- %q", providerURL, ip)
+	}
+	isIPv4 := parsedIP.To4() != nil && !strings.Contains(ip, ":")
+	if !ipv6 && !isIPv4 {
+		return "", fmt.Errorf("response from %s is not an ipv4 address :- %q", providerURL, ip)
+	}
+	if ipv6 && isIPv4 {
+		return "", fmt.Errorf("response from %s is not an ipv6 address :- %q", providerURL, ip)
+	}
+
+	return parsedIP.String(), nil
 }
 
-//getPreviousIP - gets the old IP which was previously set from a text file.
-//This way we dont have to make a unnecessary request to clould flare.
-func getPreviousIP() (string, error) {
-	file, err := os.Open("oldip.txt")
+//jsonKeyValue - the string at the dot separated key (e.g. "data.ip" or "$.addresses.0") of a JSON document, array elements are selected by index
+func jsonKeyValue(body []byte, key string) ([]byte, error) {
+	var value interface{}
+	err := json.Unmarshal(body, &value)
 	if err != nil {
-		log.Printf("error when getting previous ip :- %s", err.Error())
-		return "", err
+		return nil, err
 	}
 
-	defer file.Close()
+	for _, name := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(key, "$"), "."), ".") {
+		switch node := value.(type) {
+		case map[string]interface{}:
+			value = node[name]
+		case []interface{}:
+			index, err := strconv.Atoi(name)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, fmt.Errorf("no element %s in %s", name, key)
+			}
+			value = node[index]
+		default:
+			return nil, fmt.Errorf("no %s in %s", name, key)
+		}
+	}
 
-	ipBytes, err := ioutil.ReadAll(file)
+	ip, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a string", key)
+	}
+	return []byte(ip), nil
+}
+
+//getIPFromProviders - tries each provider in order until one of them returns a valid IP
+func getIPFromProviders(ctx context.Context, providers []string, jsonKey string, ipv6 bool) (string, error) {
+	for _, providerURL := range providers {
+		ip, err := getIPFromProvider(ctx, providerURL, jsonKey, ipv6)
+		if err == nil {
+			return ip, nil
+		}
+		log.Printf("error when getting ip from %s :- %s", providerURL, err.Error())
+	}
+	return "", errors.New("none of the ip providers returned a valid ip")
+}
 
+//getIPFromInterface - first public global unicast address of the given family bound to the named network interface
+func getIPFromInterface(name string, ipv6 bool) (string, error) {
+	networkInterface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", err
+	}
+	addresses, err := networkInterface.Addrs()
 	if err != nil {
-		log.Printf("error when getting previous ip :- %s", err.Error())
 		return "", err
 	}
+	for _, address := range addresses {
+		ipNet, ok := address.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() || ipNet.IP.IsPrivate() {
+			continue
+		}
+		if (ipNet.IP.To4() == nil) == ipv6 {
+			return ipNet.IP.String(), nil
+		}
+	}
+	if ipv6 {
+		return "", fmt.Errorf("interface %s has no public ipv6 address", name)
+	}
+	return "", fmt.Errorf("interface %s has no public ipv4 address", name)
+}
 
-	return string(ipBytes), nil
+//getCurrentIP - Gets the current Public IPv4 address from the configured ip providers (ipv4.icanhazip.com by default),
+//from the configured network interface when ipSource is "interface", from the gateway when ipSource is "upnp"
+//or from the stun server when ipSource is "stun"
+func getCurrentIP(ctx context.Context, configuration *Configuration) (string, error) {
+	var ip string
+	var err error
+	switch configuration.IPSource {
+	case "interface":
+		ip, err = getIPFromInterface(configuration.IPInterface, false)
+	case "upnp":
+		ip, err = getIPFromUPnPOrProviders(ctx, configuration)
+	case "stun":
+		ip, err = getIPFromSTUNOrProviders(ctx, configuration, false)
+	default:
+		ip, err = getIPFromProviders(ctx, configuration.IPProviders, configuration.providerJSONKey(), false)
+	}
+	if err != nil {
+		return "", err
+	}
+	return checkPublicIP(configuration, ip)
 }
 
-//getRecordIdentifier - Get Record Identifier from Cloudflare
-func getRecordIdentifier(configuration *Configuration) (string, error) {
-	//"https://api.cloudflare.com/client/v4/zones/$zone_identifier/dns_records?name=$record_name" -H "X-Auth-Email: $auth_email" -H "X-Auth-Key: $auth_key" -H "Content-Type: application/json"
-	request, err := http.NewRequest("GET", fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/dns_records?name=%s", configuration.ZoneIdentifier, configuration.RecordName), nil)
+//getCurrentIPv6 - Gets the current Public IPv6 address from the configured ipv6 providers (ipv6.icanhazip.com by default),
+//from the configured network interface when ipSource is "interface" or from the stun server when ipSource is "stun".
+//Gateways only tell their ipv4 address through upnp, so the ipv6 providers are used when ipSource is "upnp".
+func getCurrentIPv6(ctx context.Context, configuration *Configuration) (string, error) {
+	var ip string
+	var err error
+	switch configuration.IPSource {
+	case "interface":
+		ip, err = getIPFromInterface(configuration.IPInterface, true)
+	case "stun":
+		ip, err = getIPFromSTUNOrProviders(ctx, configuration, true)
+	default:
+		ip, err = getIPFromProviders(ctx, configuration.IPv6Providers, configuration.providerJSONKey(), true)
+	}
 	if err != nil {
-		log.Printf("error when getting dns record identifier :- %s", err.Error())
 		return "", err
 	}
+	return checkPublicIP(configuration, ip)
+}
 
-	request.Header.Add("X-Auth-Email", configuration.AuthEmail)
-	request.Header.Add("X-Auth-Key", configuration.AuthKey)
-	request.Header.Add("Content-Type", "application/json")
+//cgnatRange - shared address space of carrier grade nat (RFC 6598), not covered by net.IP.IsPrivate
+var cgnatRange = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
 
-	client := http.DefaultClient
+//checkPublicIP - refuses a detected ip that isn't public (private, carrier grade nat, loopback or link local),
+//returned by a misconfigured provider or behind a double nat, unless allowPrivateIP is set
+func checkPublicIP(configuration *Configuration, ip string) (string, error) {
+	if configuration.AllowPrivateIP {
+		return ip, nil
+	}
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil || !parsedIP.IsGlobalUnicast() || parsedIP.IsPrivate() || cgnatRange.Contains(parsedIP) {
+		return "", fmt.Errorf("detected address %s isn't public, not publishing it (set allowPrivateIP to publish private addresses)", ip)
+	}
+	return ip, nil
+}
 
-	resp, err := client.Do(request)
-	if err != nil {
-		log.Printf("error when getting dns record identifier :- %s", err.Error())
-		return "", err
+//providerJSONKey - key of the ip in the JSON responses of the ip providers, empty when they answer with plain text
+func (configuration *Configuration) providerJSONKey() string {
+	if configuration.IPProviderFormat != "json" {
+		return ""
 	}
+	return configuration.IPProviderJSONKey
+}
 
-	defer resp.Body.Close()
+//validateAuth - makes sure exactly one auth method (api token or legacy email + key) is configured
+func validateAuth(configuration *Configuration) error {
+	return validateCredentials(configuration.APIToken, configuration.AuthEmail, configuration.AuthKey)
+}
 
-	decoder := json.NewDecoder(resp.Body)
-	var responseJSON map[string]interface{}
-	err = decoder.Decode(&responseJSON)
+//validateCredentials - makes sure exactly one of the api token or the legacy email + key is set
+func validateCredentials(apiToken string, authEmail string, authKey string) error {
+	hasToken := apiToken != ""
+	hasLegacy := authEmail != "" || authKey != ""
 
-	if err != nil {
-		log.Printf("error when getting dns record identifier :- %s", err.Error())
-		return "", err
+	if hasToken && hasLegacy {
+		return errors.New("both apiToken and authEmail/authKey are set, configure only one auth method")
+	}
+	if !hasToken && (authEmail == "" || authKey == "") {
+		return errors.New("no auth method configured, set either apiToken or both authEmail and authKey")
 	}
+	return nil
+}
 
-	if responseJSON["success"].(bool) {
-		var result = responseJSON["result"].([]interface{})
-		if len(result) > 0 {
-			var recordMap = result[0].(map[string]interface{})
-			return recordMap["id"].(string), nil
+//addZoneRecords - adds the records of every zone to the configured records, with the zone and its credentials filled in
+func addZoneRecords(configuration *Configuration) error {
+	for i, zone := range configuration.Zones {
+		if zone.ZoneIdentifier == "" && zone.ZoneName == "" {
+			return fmt.Errorf("zones[%d] :- zoneIdentifier or zoneName is required", i)
+		}
+		if zone.APIToken != "" || zone.AuthEmail != "" || zone.AuthKey != "" {
+			err := validateCredentials(zone.APIToken, zone.AuthEmail, zone.AuthKey)
+			if err != nil {
+				return fmt.Errorf("zones[%d] :- %s", i, err.Error())
+			}
+		}
+		if len(zone.Records) == 0 {
+			return fmt.Errorf("zones[%d] :- at least one record is required", i)
+		}
+		for _, record := range zone.Records {
+			record.ZoneIdentifier = zone.ZoneIdentifier
+			record.ZoneName = zone.ZoneName
+			record.apiToken = zone.APIToken
+			record.authEmail = zone.AuthEmail
+			record.authKey = zone.AuthKey
+			configuration.Records = append(configuration.Records, record)
 		}
-		return "", errors.New("error when getting dns record identifier :- server returned empty result")
-
 	}
+	return nil
+}
 
-	return "", errors.New("error when getting dns record identifier :- server returned error")
+//hasOwnCredentials - whether the record authenticates with the credentials of its zone rather than the top level ones
+func (record *RecordConfig) hasOwnCredentials() bool {
+	return record.apiToken != "" || record.authEmail != ""
 }
 
-//updateCurrentIPToDNS - Updates current IP to cloudflare dns A record
-func updateCurrentIPToDNS(configuration *Configuration, currentIP string, dnsIdentifier string) error {
+//validate - fills in defaults for unset fields and validates the configuration, so a mistake is reported at startup
+//with the name of the setting rather than as an api error on the first check
+func (configuration *Configuration) validate() error {
+	var err error
+
+	if configuration.IntervalSeconds == 0 {
+		configuration.IntervalSeconds = defaultIntervalSeconds
+	}
+	if configuration.IntervalSeconds < 0 {
+		return fmt.Errorf("intervalSeconds must be positive, got %d", configuration.IntervalSeconds)
+	}
+	if configuration.IPv6IntervalSeconds == 0 {
+		configuration.IPv6IntervalSeconds = configuration.IntervalSeconds
+	}
+	if configuration.IPv6IntervalSeconds < 0 {
+		return fmt.Errorf("ipv6IntervalSeconds must be positive, got %d", configuration.IPv6IntervalSeconds)
+	}
+	if configuration.IntervalJitterPercent < 0 || configuration.IntervalJitterPercent > 50 {
+		return fmt.Errorf("intervalJitterPercent must be between 0 and 50, got %d", configuration.IntervalJitterPercent)
+	}
+	//by default a check is abandoned when the next one is due
+	if configuration.CheckTimeoutSeconds == 0 {
+		configuration.CheckTimeoutSeconds = configuration.IntervalSeconds
+	}
+	if configuration.CheckTimeoutSeconds < 0 {
+		return fmt.Errorf("checkTimeoutSeconds must be positive, got %d", configuration.CheckTimeoutSeconds)
+	}
+	if configuration.StabilizeDelaySeconds < 0 {
+		return fmt.Errorf("stabilizeDelaySeconds must be positive, got %d", configuration.StabilizeDelaySeconds)
+	}
+	if configuration.StableChecks == 0 {
+		configuration.StableChecks = defaultStableChecks
+	}
+	if configuration.StableChecks < 0 {
+		return fmt.Errorf("stableChecks must be positive, got %d", configuration.StableChecks)
+	}
+	//the ip is detected again within the same check
+	if configuration.StabilizeDelaySeconds >= configuration.CheckTimeoutSeconds {
+		return fmt.Errorf("stabilizeDelaySeconds must be shorter than checkTimeoutSeconds (%d), got %d", configuration.CheckTimeoutSeconds, configuration.StabilizeDelaySeconds)
+	}
 
-	//create request body
-	var dNSUpdateRequest = DNSUpdateRequest{
-		IPAddress:      currentIP,
-		EnableProxy:    configuration.EnableProxy,
-		RecordName:     configuration.RecordName,
-		RecordType:     "A",
-		ZoneIdentifier: configuration.ZoneIdentifier,
-		TTL:            120,
+	if configuration.TTL == 0 {
+		configuration.TTL = defaultTTL
+	}
+	if configuration.TTL < ttlAutomatic || configuration.TTL > maxTTL {
+		return fmt.Errorf("ttl must be 1 or \"auto\" (automatic), or up to %d seconds, got %d", maxTTL, configuration.TTL)
+	}
+
+	if configuration.HTTPTimeoutSeconds == 0 {
+		configuration.HTTPTimeoutSeconds = defaultHTTPTimeoutSeconds
+	}
+	if configuration.HTTPTimeoutSeconds < 0 {
+		return fmt.Errorf("httpTimeoutSeconds must be positive, got %d", configuration.HTTPTimeoutSeconds)
 	}
-	dNSUpdateRequestJSON, err := json.Marshal(dNSUpdateRequest)
 
+	if configuration.MaxRetries < 0 {
+		return fmt.Errorf("maxRetries can't be negative, got %d", configuration.MaxRetries)
+	}
+	if configuration.RetryDelaySeconds == 0 {
+		configuration.RetryDelaySeconds = defaultRetryDelaySeconds
+	}
+	if configuration.RetryDelaySeconds < 0 {
+		return fmt.Errorf("retryDelaySeconds must be positive, got %d", configuration.RetryDelaySeconds)
+	}
+	if configuration.CircuitBreakerFailures == 0 {
+		configuration.CircuitBreakerFailures = defaultCircuitBreakerFailures
+	}
+	if configuration.CircuitBreakerFailures < 0 {
+		return fmt.Errorf("circuitBreakerFailures must be positive, got %d", configuration.CircuitBreakerFailures)
+	}
+	if configuration.CircuitBreakerCooldownSeconds == 0 {
+		configuration.CircuitBreakerCooldownSeconds = defaultCircuitBreakerCooldownSeconds
+	}
+	if configuration.CircuitBreakerCooldownSeconds < 0 {
+		return fmt.Errorf("circuitBreakerCooldownSeconds must be positive, got %d", configuration.CircuitBreakerCooldownSeconds)
+	}
+	if configuration.ShutdownTimeoutSeconds == 0 {
+		configuration.ShutdownTimeoutSeconds = defaultShutdownTimeoutSeconds
+	}
+	if configuration.ShutdownTimeoutSeconds < 0 {
+		return fmt.Errorf("shutdownTimeoutSeconds must be positive, got %d", configuration.ShutdownTimeoutSeconds)
+	}
+	if configuration.Concurrency == 0 {
+		configuration.Concurrency = defaultConcurrency
+	}
+	if configuration.Concurrency < 0 {
+		return fmt.Errorf("concurrency must be positive, got %d", configuration.Concurrency)
+	}
+	if configuration.IPv6PrefixLength == 0 {
+		configuration.IPv6PrefixLength = defaultIPv6PrefixLength
+	}
+	if configuration.IPv6PrefixLength < 1 || configuration.IPv6PrefixLength > 127 {
+		return fmt.Errorf("ipv6PrefixLength must be between 1 and 127, got %d", configuration.IPv6PrefixLength)
+	}
+	if configuration.MaxConsecutiveFailures < 0 {
+		return fmt.Errorf("maxConsecutiveFailures can't be negative, got %d", configuration.MaxConsecutiveFailures)
+	}
+
+	if len(configuration.IPProviders) == 0 {
+		configuration.IPProviders = defaultIPProviders
+	}
+	if len(configuration.IPv6Providers) == 0 {
+		configuration.IPv6Providers = defaultIPv6Providers
+	}
+	if configuration.APIBaseURL == "" {
+		configuration.APIBaseURL = defaultAPIBaseURL
+	}
+	err = validateURLs("apiBaseURL", []string{configuration.APIBaseURL})
 	if err != nil {
-		log.Printf("error when updating dns record :- %s", err.Error())
 		return err
 	}
 
-	request, err := http.NewRequest("PUT", fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/dns_records/%s",
-		configuration.ZoneIdentifier,
-		dnsIdentifier),
-		bytes.NewBuffer(dNSUpdateRequestJSON))
+	err = validateURLs("ipProviders", configuration.IPProviders)
+	if err != nil {
+		return err
+	}
+	err = validateURLs("ipv6Providers", configuration.IPv6Providers)
+	if err != nil {
+		return err
+	}
+	err = validateURLs("crossCheckProviders", configuration.CrossCheckProviders)
 	if err != nil {
-		log.Printf("error when updating dns record :- %s", err.Error())
 		return err
 	}
+	err = validateURLs("crossCheckIPv6Providers", configuration.CrossCheckIPv6Providers)
+	if err != nil {
+		return err
+	}
+	if configuration.CrossCheckEvery == 0 {
+		configuration.CrossCheckEvery = defaultCrossCheckEvery
+	}
+	if configuration.CrossCheckEvery < 0 {
+		return fmt.Errorf("crossCheckEvery must be positive, got %d", configuration.CrossCheckEvery)
+	}
+	if configuration.CrossCheckMismatches == 0 {
+		configuration.CrossCheckMismatches = defaultCrossCheckMismatches
+	}
+	if configuration.CrossCheckMismatches < 0 {
+		return fmt.Errorf("crossCheckMismatches must be positive, got %d", configuration.CrossCheckMismatches)
+	}
+	for name, webhookURL := range map[string]string{
+		"notifyWebhookURL":  configuration.NotifyWebhookURL,
+		"discordWebhookURL": configuration.DiscordWebhookURL,
+		"slackWebhookURL":   configuration.SlackWebhookURL,
+	} {
+		if webhookURL == "" {
+			continue
+		}
+		err = validateURLs(name, []string{webhookURL})
+		if err != nil {
+			return err
+		}
+	}
 
-	//add header
-	request.Header.Add("X-Auth-Email", configuration.AuthEmail)
-	request.Header.Add("X-Auth-Key", configuration.AuthKey)
-	request.Header.Add("Content-Type", "application/json")
+	if configuration.MaintenanceWindow != nil {
+		err = configuration.MaintenanceWindow.validate()
+		if err != nil {
+			return err
+		}
+	}
 
-	client := http.DefaultClient
-	resp, err := client.Do(request)
+	if configuration.IPProviderFormat != "" && configuration.IPProviderFormat != "text" && configuration.IPProviderFormat != "json" {
+		return fmt.Errorf("ipProviderFormat must be text or json, got %s", configuration.IPProviderFormat)
+	}
+	if configuration.IPProviderFormat == "json" && configuration.IPProviderJSONKey == "" {
+		configuration.IPProviderJSONKey = defaultIPProviderJSONKey
+	}
+
+	if configuration.UpdateMethod == "" {
+		configuration.UpdateMethod = "put"
+	}
+	if configuration.UpdateMethod != "put" && configuration.UpdateMethod != "patch" {
+		return fmt.Errorf("updateMethod must be put or patch, got %s", configuration.UpdateMethod)
+	}
+
+	if configuration.IPSource != "" && configuration.IPSource != "http" && configuration.IPSource != "interface" && configuration.IPSource != "upnp" &&
+		configuration.IPSource != "stun" {
+		return fmt.Errorf("ipSource must be http, interface, upnp or stun, got %s", configuration.IPSource)
+	}
+	if configuration.IPSourceAddress != "" && net.ParseIP(configuration.IPSourceAddress) == nil {
+		_, err = net.InterfaceByName(configuration.IPSourceAddress)
+		if err != nil {
+			return fmt.Errorf("ipSourceAddress must be a local ip address or the name of a network interface, got %s", configuration.IPSourceAddress)
+		}
+	}
+	if configuration.IPSource == "interface" && configuration.IPInterface == "" {
+		return errors.New("ipInterface is required when ipSource is interface")
+	}
+	if configuration.STUNServer == "" {
+		configuration.STUNServer = defaultSTUNServer
+	}
+	if _, port, err := net.SplitHostPort(configuration.STUNServer); err != nil || port == "" {
+		return fmt.Errorf("stunServer must be host:port, got %s", configuration.STUNServer)
+	}
+
+	if configuration.ProxyURL != "" {
+		proxyURL, err := url.Parse(configuration.ProxyURL)
+		if err != nil || proxyURL.Host == "" {
+			return errors.New("proxyURL must be an url like http://proxy:3128 or socks5://proxy:1080")
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("proxyURL scheme must be http, https, socks5 or socks5h, got %s", proxyURL.Scheme)
+		}
+	}
+
+	if configuration.UserAgent == "" {
+		configuration.UserAgent = "cloudflare-ddns-golang/" + version
+	}
+
+	if configuration.StateFile == "" {
+		configuration.StateFile = defaultStateFile
+	}
+
+	//by default allow a couple of failed checks before reporting unhealthy
+	if configuration.HealthThresholdSeconds == 0 {
+		configuration.HealthThresholdSeconds = 3 * configuration.IntervalSeconds
+	}
+	if configuration.HealthThresholdSeconds < 0 {
+		return fmt.Errorf("healthThresholdSeconds must be positive, got %d", configuration.HealthThresholdSeconds)
+	}
+
+	if configuration.LogFormat != "" && configuration.LogFormat != "text" && configuration.LogFormat != "json" {
+		return fmt.Errorf("logFormat must be text or json, got %s", configuration.LogFormat)
+	}
+	if configuration.LogDestination == "" {
+		configuration.LogDestination = "both"
+	}
+	if configuration.LogDestination != "both" && configuration.LogDestination != "stdout" && configuration.LogDestination != "file" {
+		return fmt.Errorf("logDestination must be both, stdout or file, got %s", configuration.LogDestination)
+	}
+	if configuration.LogFile == "" {
+		configuration.LogFile = defaultLogFile
+	}
+	if configuration.LogMaxSizeMB == 0 {
+		configuration.LogMaxSizeMB = defaultLogMaxSizeMB
+	}
+	if configuration.LogMaxSizeMB < 0 {
+		return fmt.Errorf("logMaxSizeMB must be positive, got %d", configuration.LogMaxSizeMB)
+	}
+	if configuration.LogMaxFiles == 0 {
+		configuration.LogMaxFiles = defaultLogMaxFiles
+	}
+	if configuration.LogMaxFiles < 0 {
+		return fmt.Errorf("logMaxFiles must be positive, got %d", configuration.LogMaxFiles)
+	}
+	if configuration.HeartbeatSeconds == 0 {
+		configuration.HeartbeatSeconds = defaultHeartbeatSeconds
+	}
+	if configuration.HeartbeatSeconds < 0 {
+		return fmt.Errorf("heartbeatSeconds must be positive, got %d", configuration.HeartbeatSeconds)
+	}
+	if configuration.RecordCacheTTLSeconds == 0 {
+		configuration.RecordCacheTTLSeconds = defaultRecordCacheTTLSeconds
+	}
+	if configuration.RecordCacheTTLSeconds < 0 {
+		return fmt.Errorf("recordCacheTTLSeconds must be positive, got %d", configuration.RecordCacheTTLSeconds)
+	}
+	if configuration.LogLevel != "" && configuration.LogLevel != "error" && configuration.LogLevel != "info" && configuration.LogLevel != "debug" {
+		return fmt.Errorf("logLevel must be error, info or debug, got %s", configuration.LogLevel)
+	}
+
+	if configuration.SMTPPort == 0 {
+		configuration.SMTPPort = defaultSMTPPort
+	}
+	//email is optional, an incomplete setup only disables it
+	if configuration.SMTPHost != "" && (configuration.SMTPFrom == "" || len(configuration.SMTPTo) == 0) {
+		log.Println("smtpHost is set without smtpFrom and smtpTo, email notifications are disabled")
+	}
+
+	if len(configuration.Records) == 0 && len(configuration.Zones) == 0 {
+		configuration.Records = []RecordConfig{{
+			RecordName:     configuration.RecordName,
+			ZoneIdentifier: configuration.ZoneIdentifier,
+			ZoneName:       configuration.ZoneName,
+			TTL:            configuration.TTL,
+		}}
+	}
+	err = addZoneRecords(configuration)
 	if err != nil {
-		log.Printf("error when updating dns record :- %s", err.Error())
 		return err
 	}
 
-	defer resp.Body.Close()
+	//the top level credentials are only optional when every record uses the ones of its zone
+	needsAuth := configuration.APIToken != "" || configuration.AuthEmail != "" || configuration.AuthKey != ""
+	for i := range configuration.Records {
+		needsAuth = needsAuth || !configuration.Records[i].hasOwnCredentials()
+	}
+	if needsAuth {
+		err = validateAuth(configuration)
+		if err != nil {
+			return err
+		}
+	}
 
-	decoder := json.NewDecoder(resp.Body)
-	var responseJSON map[string]interface{}
-	err = decoder.Decode(&responseJSON)
+	for i := range configuration.Records {
+		record := &configuration.Records[i]
+		//an explicit zone identifier wins over a zone name, from the record or the top level
+		if record.ZoneIdentifier == "" && record.ZoneName == "" {
+			record.ZoneIdentifier = configuration.ZoneIdentifier
+			record.ZoneName = configuration.ZoneName
+		}
+		inheritsProxy := record.EnableProxy == nil
+		if inheritsProxy {
+			proxy := configuration.EnableProxy
+			record.EnableProxy = &proxy
+		}
+		if record.TTL == 0 {
+			record.TTL = configuration.TTL
+		}
+		if record.Comment == "" {
+			record.Comment = configuration.RecordComment
+		}
+		if record.Tags == nil {
+			record.Tags = configuration.RecordTags
+		}
+		//with a zone name the record can be configured with its label only
+		if record.ZoneName != "" {
+			record.RecordName = qualifiedRecordName(record.RecordName, record.ZoneName)
+		}
+		if record.RecordName == "" || record.RecordName == "@" {
+			return fmt.Errorf("records[%d] :- name is required, or zoneName to use a label or @ for the apex", i)
+		}
+		if !isValidRecordName(record.RecordName) {
+			return fmt.Errorf("record %s :- name is not a valid domain name", record.RecordName)
+		}
+		if record.ZoneIdentifier == "" && record.ZoneName == "" {
+			return fmt.Errorf("record %s :- zoneIdentifier or zoneName is required", record.RecordName)
+		}
+		if record.ZoneIdentifier == "" && !isValidHostname(record.ZoneName) {
+			return fmt.Errorf("record %s :- zoneName %q is not a valid domain name", record.RecordName, record.ZoneName)
+		}
+		if record.TTL < ttlAutomatic || record.TTL > maxTTL {
+			return fmt.Errorf("record %s :- ttl must be 1 or \"auto\" (automatic), or up to %d seconds, got %d", record.RecordName, maxTTL, record.TTL)
+		}
+		err = validateRecordContent(record)
+		if err != nil {
+			return fmt.Errorf("record %s :- %s", record.RecordName, err.Error())
+		}
+		err = validateHostSuffix(record, configuration.IPv6PrefixLength)
+		if err != nil {
+			return fmt.Errorf("record %s :- %s", record.RecordName, err.Error())
+		}
+		//cloudflare only proxies A, AAAA and CNAME records, the top level proxy setting doesn't apply to the others
+		if record.proxied() && !isProxiable(record.RecordType) {
+			if !inheritsProxy {
+				return fmt.Errorf("record %s :- proxy can't be set on %s records, only on A, AAAA and CNAME records", record.RecordName, record.RecordType)
+			}
+			proxy := false
+			record.EnableProxy = &proxy
+		}
+	}
+	return nil
+}
+
+func init() {
+
+	// log to console until the configuration tells where to log, see setupLogOutput
+	logOutput = os.Stdout
 
+	log.SetOutput(logOutput)
+	log.SetPrefix("DDNS SCRIPT ")
+	log.SetFlags(log.LstdFlags | log.Lshortfile) //Log Line Number to Debug errors
+}
+
+//writePIDFile - writes the process id to path, a stale file left by a process that didn't shut down cleanly is overwritten
+func writePIDFile(path string) error {
+	previous, err := os.ReadFile(path)
+	if err == nil {
+		log.Printf("overwriting stale pid file %s (pid %s)", path, strings.TrimSpace(string(previous)))
+	}
+	err = writeFileAtomic(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
 	if err != nil {
-		log.Printf("error when getting dns record identifier :- %s", err.Error())
 		return err
 	}
+	log.Printf("wrote pid %d to %s", os.Getpid(), path)
+	return nil
+}
 
-	if !responseJSON["success"].(bool) {
-		return fmt.Errorf("error when updating dns record %v", responseJSON)
+//removePIDFile - removes the pid file on a clean shutdown
+func removePIDFile(path string) {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("error when removing pid file :- %s", err.Error())
 	}
+}
+
+//waitForCheck - waits for an in-progress check to finish so an update isn't cut off mid request,
+//aborting it through cancel once timeout has elapsed
+func waitForCheck(checks *sync.WaitGroup, timeout time.Duration, cancel context.CancelFunc) {
+	finished := make(chan struct{})
+	go func() {
+		checks.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(timeout):
+		log.Printf("check still running after %s, aborting it", timeout)
+		cancel()
+		<-finished
+	}
+}
+
+//nextCheckDelay - interval until the next check of the family (ipv6IntervalSeconds for ipv6), randomly spread by up to intervalJitterPercent either way
+//so a fleet of daemons started together doesn't keep hitting the ip providers and cloudflare at the same time
+func nextCheckDelay(configuration *Configuration, family string) time.Duration {
+	interval := time.Duration(configuration.IntervalSeconds) * time.Second
+	if family == familyIPv6 {
+		interval = time.Duration(configuration.IPv6IntervalSeconds) * time.Second
+	}
+	spread := interval * time.Duration(configuration.IntervalJitterPercent) / 100
+	if spread <= 0 {
+		return interval
+	}
+	return interval - spread + time.Duration(rand.Int63n(int64(2*spread)+1))
+}
+
+//doEvery - calls f with the tick time every d until ctx is cancelled, the ticker is stopped on return
+func doEvery(ctx context.Context, d time.Duration, f func(time.Time)) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case x := <-ticker.C:
+			f(x)
+		}
+	}
+}
 
+//checkAndUpdateRecords - updates every configured record of the given type whose published content, as remembered in the state, differs from the current ip.
+//A failure on one record doesn't skip the rest, only the updated records are remembered so failed ones are retried next tick.
+func checkAndUpdateRecords(ctx context.Context, client *cloudflareClient, notifier Notifier, configuration *Configuration, state *State, recordType string, currentPublicIP string) error {
+	metrics.setDetectedIP(recordType, currentPublicIP)
+	if holdUntilCrossChecked(ctx, configuration, recordType, currentPublicIP) {
+		return nil
+	}
+	if holdUntilStable(configuration, state, recordType, currentPublicIP) {
+		return nil
+	}
+
+	var records []*RecordConfig
+	for i := range configuration.Records {
+		if configuration.Records[i].followsDetectedIP(recordType, configuration.EnableIPv6) {
+			records = append(records, &configuration.Records[i])
+		}
+	}
+
+	var mutex sync.Mutex
+	failed := 0
+	total := len(records)
+	unchanged := 0
+	pending := 0
+	forEachRecord(records, configuration.Concurrency, func(record *RecordConfig) {
+		content, err := record.detectedContent(recordType, currentPublicIP, configuration.IPv6PrefixLength)
+		if err != nil {
+			logRecordFailure(record, recordType, err)
+			mutex.Lock()
+			failed++
+			mutex.Unlock()
+			return
+		}
+
+		//compare with the content last published, unless asked to compare against the live records on every check
+		if state.isPublished(record, recordType, content) && !configuration.VerifyRecords && !configuration.forceUpdate {
+			mutex.Lock()
+			unchanged++
+			mutex.Unlock()
+			metrics.setRecordResult(record, recordType, content, false, nil)
+			return
+		}
+
+		updated, err := updateRecord(ctx, client, notifier, configuration, record, recordType, content)
+		if err == errUpdatePending {
+			mutex.Lock()
+			pending++
+			mutex.Unlock()
+			return
+		}
+		metrics.setRecordResult(record, recordType, content, updated, err)
+		if err != nil {
+			logRecordFailure(record, recordType, err)
+			mutex.Lock()
+			failed++
+			mutex.Unlock()
+			return
+		}
+		if updated {
+			metrics.recordUpdate()
+		}
+		if !configuration.DryRun {
+			state.setPublished(record, recordType, content)
+		}
+	})
+	if total > 0 && unchanged == total {
+		logUnchanged(configuration, recordType, currentPublicIP)
+		metrics.recordUnchanged()
+	}
+	if failed > 0 {
+		return fmt.Errorf("error when updating %s records :- %d of %d failed", recordType, failed, total)
+	}
+
+	if !configuration.DryRun && pending == 0 {
+		metrics.setPublishedIP(recordType, currentPublicIP)
+	}
 	return nil
 }
 
-func init() {
+//logRecordFailure - logs and counts a record that failed to update, and keeps it in the event log
+func logRecordFailure(record *RecordConfig, recordType string, err error) {
+	log.Printf("error when updating record=%s type=%s :- %s", record.RecordName, recordType, err.Error())
+	metrics.recordUpdateFailure()
+	events.add("error", "error when updating %s record %s :- %s", recordType, record.RecordName, err.Error())
+}
 
-	// log to console and file
-	f, err := os.OpenFile("ddns.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+//forEachRecord - calls update for every record, at most concurrency records at a time, and waits for all of them.
+//A failing record doesn't stop the others, update reports its own errors.
+func forEachRecord(records []*RecordConfig, concurrency int, update func(record *RecordConfig)) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	workers := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, record := range records {
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(record *RecordConfig) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			update(record)
+		}(record)
+	}
+	wg.Wait()
+}
+
+//recordCacheKey - key of the record in recordIdentifiers
+func recordCacheKey(record *RecordConfig, recordType string) string {
+	return record.ZoneIdentifier + "/" + record.RecordName + "/" + recordType
+}
+
+//cachedRecordIdentifier - record identifier cached by getLiveRecord, records are checked concurrently.
+//An identifier cached more than maxAge ago is dropped, so it's looked up by name again.
+func cachedRecordIdentifier(cacheKey string, maxAge time.Duration) (string, bool) {
+	recordIdentifiersMutex.Lock()
+	defer recordIdentifiersMutex.Unlock()
+	cached, ok := recordIdentifiers[cacheKey]
+	if ok && time.Since(cached.cachedAt) >= maxAge {
+		logDebugf("cached dns record id %s of %s expired, looking it up again", cached.id, cacheKey)
+		delete(recordIdentifiers, cacheKey)
+		return "", false
+	}
+	return cached.id, ok
+}
+
+//cacheRecordIdentifier - caches the record identifier, an empty one removes it from the cache
+func cacheRecordIdentifier(cacheKey string, dnsRecordID string) {
+	recordIdentifiersMutex.Lock()
+	defer recordIdentifiersMutex.Unlock()
+	if dnsRecordID == "" {
+		delete(recordIdentifiers, cacheKey)
+		return
+	}
+	recordIdentifiers[cacheKey] = cachedRecord{id: dnsRecordID, cachedAt: time.Now()}
+}
+
+//getLiveRecord - fetches the record currently published in cloudflare.
+//The record identifier is only looked up by name the first time and then reused for recordCacheTTLSeconds, unless cloudflare says
+//it no longer exists (record deleted/recreated) in which case it is looked up by name again.
+func getLiveRecord(ctx context.Context, client *cloudflareClient, record *RecordConfig, recordType string) (cloudflareRecord, error) {
+	cacheKey := recordCacheKey(record, recordType)
+	maxAge := time.Duration(client.configuration.RecordCacheTTLSeconds) * time.Second
+	if dnsRecordID, ok := cachedRecordIdentifier(cacheKey, maxAge); ok {
+		liveRecord, err := client.getDNSRecord(ctx, record, dnsRecordID)
+		if err != errRecordNotFound {
+			return liveRecord, err
+		}
+		logDebugf("cached dns record id %s not found, looking it up again", dnsRecordID)
+		cacheRecordIdentifier(cacheKey, "")
+	}
+
+	//get DNS record identifier
+	liveRecord, err := client.lookupDNSRecord(ctx, record, recordType)
 	if err != nil {
-		log.Fatalf("error opening file: %v", err)
+		return liveRecord, err
 	}
-	wrt := io.MultiWriter(os.Stdout, f)
+	logDebugf("dns record id : %s", liveRecord.ID)
+	cacheRecordIdentifier(cacheKey, liveRecord.ID)
+	return liveRecord, nil
+}
 
-	log.SetOutput(wrt)
-	log.SetPrefix("DDNS SCRIPT ")
-	log.SetFlags(log.LstdFlags | log.Lshortfile) //Log Line Number to Debug errors
+//updateRecord - points the record at content (the current ip for A and AAAA records), returns whether a change was made.
+//The live record is compared first so a record already pointing at the ip (e.g. after state.json was lost) isn't updated again.
+//In dry run mode the change is only logged.
+func updateRecord(ctx context.Context, client *cloudflareClient, notifier Notifier, configuration *Configuration, record *RecordConfig, recordType string, content string) (bool, error) {
+	liveRecord, err := getLiveRecord(ctx, client, record, recordType)
+	if err == errRecordNotFound && configuration.CreateIfMissing {
+		if holdForMaintenanceWindow(configuration, record, recordType, "", content) {
+			return false, errUpdatePending
+		}
+		if configuration.DryRun {
+			log.Printf("dry run :- would create %s record %s with content %s, ttl %d, proxy %t",
+				recordType, record.RecordName, content, record.TTL, record.proxied())
+			return false, nil
+		}
+		dnsRecordID, err := client.createDNSRecord(ctx, record, content, recordType)
+		if err != nil {
+			return false, fmt.Errorf("error when creating dns record :- %s", err.Error())
+		}
+		log.Printf("created record=%s type=%s new=%s", record.RecordName, recordType, content)
+		events.add("update", "created %s record %s with %s", recordType, record.RecordName, content)
+		logDebugf("created dns record id : %s", dnsRecordID)
+		cacheRecordIdentifier(recordCacheKey(record, recordType), dnsRecordID)
+		notifier.OnUpdate(ctx, record, recordType, "", content)
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error when getting dns record :- %s", err.Error())
+	}
+
+	if liveRecord.Content == content && settingsMatch(liveRecord, record) && !configuration.forceUpdate {
+		logDebugf("%s record %s already points at %s", recordType, record.RecordName, content)
+		clearPendingChange(record, recordType)
+		return false, nil
+	}
+	if holdForMaintenanceWindow(configuration, record, recordType, liveRecord.Content, content) {
+		return false, errUpdatePending
+	}
+
+	if configuration.DryRun {
+		log.Printf("dry run :- would update %s record %s (id %s) from %s to %s, ttl %d (now %d), proxy %t (now %t)",
+			recordType, record.RecordName, liveRecord.ID, liveRecord.Content, content, record.TTL, liveRecord.TTL, record.proxied(), liveRecord.Proxied)
+		return false, nil
+	}
+
+	//update content to dns
+	err = client.updateCurrentIPToDNS(ctx, record, content, liveRecord, recordType)
+	if err == errRecordNotFound {
+		//deleted or recreated since it was fetched, the identifier is looked up by name again on the next check
+		cacheRecordIdentifier(recordCacheKey(record, recordType), "")
+	}
+	if err != nil {
+		return false, fmt.Errorf("error when updating dns record :- %w", err)
+	}
+	//a proxy or ttl change alone isn't worth a notification
+	if liveRecord.Content == content {
+		log.Printf("updated record=%s type=%s proxied=%t ttl=%d", record.RecordName, recordType, record.proxied(), record.TTL)
+		events.add("update", "updated %s record %s to proxied %t, ttl %d", recordType, record.RecordName, record.proxied(), record.TTL)
+		return true, nil
+	}
+	log.Printf("updated record=%s type=%s old=%s new=%s", record.RecordName, recordType, liveRecord.Content, content)
+	events.add("update", "updated %s record %s from %s to %s", recordType, record.RecordName, liveRecord.Content, content)
+	notifier.OnUpdate(ctx, record, recordType, liveRecord.Content, content)
+	return true, nil
+}
+
+//settingsMatch - whether the live record has the proxy and ttl settings of the configuration.
+//Cloudflare reports the ttl of proxied records as 1 (automatic) whatever was sent, so it's only compared for dns only records.
+func settingsMatch(liveRecord cloudflareRecord, record *RecordConfig) bool {
+	if liveRecord.Proxied != record.proxied() {
+		return false
+	}
+	if record.Priority != nil && (liveRecord.Priority == nil || *liveRecord.Priority != *record.Priority) {
+		return false
+	}
+	return record.proxied() || liveRecord.TTL == int(record.TTL)
+}
+
+//checkAndUpdateStaticRecords - keeps the records with a fixed content (CNAME, TXT or literal A/AAAA) in sync.
+//They are only compared against cloudflare again once their content changes (e.g. on reload), or on every check with verifyRecords.
+func checkAndUpdateStaticRecords(ctx context.Context, client *cloudflareClient, notifier Notifier, configuration *Configuration, state *State) error {
+	var records []*RecordConfig
+	for i := range configuration.Records {
+		if configuration.Records[i].Content != "" {
+			records = append(records, &configuration.Records[i])
+		}
+	}
+
+	var mutex sync.Mutex
+	failed := 0
+	forEachRecord(records, configuration.Concurrency, func(record *RecordConfig) {
+		if state.isPublished(record, record.RecordType, record.Content) && !configuration.VerifyRecords && !configuration.forceUpdate {
+			return
+		}
+
+		updated, err := updateRecord(ctx, client, notifier, configuration, record, record.RecordType, record.Content)
+		if err == errUpdatePending {
+			return
+		}
+		metrics.setRecordResult(record, record.RecordType, record.Content, updated, err)
+		if err != nil {
+			logRecordFailure(record, record.RecordType, err)
+			mutex.Lock()
+			failed++
+			mutex.Unlock()
+			return
+		}
+		if updated {
+			metrics.recordUpdate()
+		}
+		if !configuration.DryRun {
+			state.setPublished(record, record.RecordType, record.Content)
+		}
+	})
+	if failed > 0 {
+		return fmt.Errorf("error when updating records with a fixed content :- %d failed", failed)
+	}
+	return nil
 }
 
-func doEvery(d time.Duration, f func(time.Time)) {
-	for x := range time.Tick(d) {
-		f(x)
+//resolveZoneIdentifiers - fills the zone identifier of the records configured with a zone name only.
+//Each name is looked up once and cached, a failed lookup is retried on the next check.
+func resolveZoneIdentifiers(ctx context.Context, client *cloudflareClient, configuration *Configuration) error {
+	for i := range configuration.Records {
+		record := &configuration.Records[i]
+		if record.ZoneIdentifier != "" {
+			continue
+		}
+		zoneIdentifier, ok := zoneIdentifiers[record.ZoneName]
+		if !ok {
+			var err error
+			zoneIdentifier, err = client.lookupZoneIdentifier(ctx, record)
+			if err != nil {
+				return fmt.Errorf("error when resolving zone %s :- %s", record.ZoneName, err.Error())
+			}
+			zoneIdentifiers[record.ZoneName] = zoneIdentifier
+			log.Printf("resolved zone=%s id=%s", record.ZoneName, zoneIdentifier)
+		}
+		record.ZoneIdentifier = zoneIdentifier
+	}
+	return nil
+}
+
+//checkAndUpdateDNS - runs a single check of the A (and AAAA) records following the ip and of the records with a fixed content.
+//Returns whether the ip was detected and every record was updated.
+//Errors are only logged so a transient failure doesn't stop the daemon, the next tick retries.
+//A check still running after checkTimeoutSeconds (retries of several records adding up) is aborted, so checks never pile up.
+//Only one check runs at a time, one started while another is in progress is skipped and reported as ok, the running one tells the outcome.
+func checkAndUpdateDNS(ctx context.Context, configuration *Configuration) bool {
+	if !checkInProgress.TryLock() {
+		log.Println("previous check still running, skipping this one")
+		return true
+	}
+	defer checkInProgress.Unlock()
+
+	if forceNextCheck.Swap(false) {
+		log.Println("forcing an update of every record")
+		forced := *configuration
+		forced.forceUpdate = true
+		configuration = &forced
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(configuration.CheckTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	ok := runCheck(ctx, configuration, newCloudflareClient(configuration), newNotifier(configuration), getCurrentIP, getCurrentIPv6)
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("error when checking :- check aborted after %s, the remaining records are retried on the next check",
+			time.Duration(configuration.CheckTimeoutSeconds)*time.Second)
 	}
+	return ok
 }
 
-func checkAndUpdateDNS(configuration *Configuration) {
+//forceNextCheck - set by -force and SIGUSR1, the next check pushes every record even when it looks up to date
+//(e.g. after the record was edited in the dashboard)
+var forceNextCheck atomic.Bool
+
+//checkInProgress - held by the running check, two checks would race on the state file and the record identifiers
+var checkInProgress sync.Mutex
+
+//ipDetector - detects the current public ip of one family, getCurrentIP or getCurrentIPv6 outside of tests
+type ipDetector func(ctx context.Context, configuration *Configuration) (string, error)
+
+//runCheck - checkAndUpdateDNS with the cloudflare client, the notifier and the ip detection passed in,
+//so a check can be run against stubs without the network
+func runCheck(ctx context.Context, configuration *Configuration, client *cloudflareClient, notifier Notifier, detectIP ipDetector, detectIPv6 ipDetector) bool {
 	var currentPublicIP string
-	var previousPublicIP string
 	var err error
-	//get current ip address
-	currentPublicIP, err = getCurrentIP()
+	var failures []string
+	metrics.recordCheck()
+
+	err = resolveZoneIdentifiers(ctx, client, configuration)
 	if err != nil {
-		log.Fatalf("error when getting current ip :- %s", err.Error())
+		log.Println(err.Error())
+		recordFailedCheck(ctx, notifier, []string{err.Error()})
+		return false
 	}
-	log.Printf("Current public ipv4 address :- %s", currentPublicIP)
-
-	//get ip address previously set to cloudflare
-	previousPublicIP, err = getPreviousIP()
+	state, err := loadState(configuration.StateFile)
 	if err != nil {
-		log.Fatalf("error when getting previous ip :- %s", err.Error())
+		log.Println(err.Error())
+		recordFailedCheck(ctx, notifier, []string{err.Error()})
+		return false
 	}
-	log.Printf("Current previous ipv4 address :- %s", previousPublicIP)
 
-	//compare both ip addresses
-	if strings.Trim(previousPublicIP, "") != strings.Trim(currentPublicIP, "") {
-		//get DNS record identifier
-		var dnsRecordID string
-		dnsRecordID, err = getRecordIdentifier(configuration)
+	//get current ip address
+	if configuration.checkFamily != familyIPv6 && needsDetectedIP(configuration, "A") {
+		currentPublicIP, err = detectIP(ctx, configuration)
+		if err == nil {
+			err = waitForStableIP(ctx, configuration, state, detectIP, "A", currentPublicIP)
+		}
 		if err != nil {
-			log.Fatalf("error when getting dns record identifier :- %s", err.Error())
+			failure := fmt.Sprintf("error when getting current ip :- %s", err.Error())
+			log.Println(failure)
+			metrics.recordIPDetectionFailure()
+			failures = append(failures, failure)
+		} else {
+			logDebugf("Current public ipv4 address :- %s", currentPublicIP)
+			err = checkAndUpdateRecords(ctx, client, notifier, configuration, state, "A", currentPublicIP)
+			if err != nil {
+				log.Println(err.Error())
+				failures = append(failures, err.Error())
+			}
 		}
-		log.Printf("dns record id : %s", dnsRecordID)
+	}
 
-		//update ip address to dns
-		err = updateCurrentIPToDNS(configuration, currentPublicIP, dnsRecordID)
+	if configuration.checkFamily != familyIPv4 && needsDetectedIP(configuration, "AAAA") {
+		//get current ipv6 address
+		currentPublicIP, err = detectIPv6(ctx, configuration)
+		if err == nil {
+			err = waitForStableIP(ctx, configuration, state, detectIPv6, "AAAA", currentPublicIP)
+		}
 		if err != nil {
-			log.Fatalf("error when updating dns record :- %s", err.Error())
+			failure := fmt.Sprintf("error when getting current ipv6 :- %s", err.Error())
+			log.Println(failure)
+			metrics.recordIPDetectionFailure()
+			failures = append(failures, failure)
+		} else {
+			logDebugf("Current public ipv6 address :- %s", currentPublicIP)
+			err = checkAndUpdateRecords(ctx, client, notifier, configuration, state, "AAAA", currentPublicIP)
+			if err != nil {
+				log.Println(err.Error())
+				failures = append(failures, err.Error())
+			}
 		}
+	}
 
-		ipAddressBuffer := []byte(currentPublicIP)
-		err := ioutil.WriteFile("oldip.txt", ipAddressBuffer, 0644)
+	if configuration.checkFamily != familyIPv6 {
+		err = checkAndUpdateStaticRecords(ctx, client, notifier, configuration, state)
 		if err != nil {
-			log.Fatalf("error when writing to oldip.txt :- %s", err.Error())
+			log.Println(err.Error())
+			failures = append(failures, err.Error())
 		}
-	} else {
-		log.Println("both current and previous ip addresses are the same, exiting...")
+	}
+
+	//records updated before a failure are remembered too, a dry run changes nothing (not even the stableChecks candidates)
+	if state.changed && !configuration.DryRun {
+		err = saveState(configuration.StateFile, state)
+		if err != nil {
+			log.Println(err.Error())
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		recordFailedCheck(ctx, notifier, failures)
+		return false
+	}
+	consecutiveFailedChecks = 0
+	metrics.recordHealthyCheck()
+	events.add("check", "check succeeded")
+	return true
+}
+
+//waitForStableIP - with stabilizeDelaySeconds, when ip differs from the content published for a record following it,
+//detects the ip again after the delay and fails the detection unless it's still ip, so an address seen briefly (e.g. during a PPPoE redial) isn't published
+func waitForStableIP(ctx context.Context, configuration *Configuration, state *State, detect ipDetector, recordType string, ip string) error {
+	if configuration.StabilizeDelaySeconds == 0 || !ipChanged(configuration, state, recordType, ip) {
+		return nil
+	}
+
+	delay := time.Duration(configuration.StabilizeDelaySeconds) * time.Second
+	log.Printf("%s address changed to %s, checking it again in %s before updating", recordType, ip, delay)
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	stableIP, err := detect(ctx, configuration)
+	if err != nil {
+		return err
+	}
+	if stableIP != ip {
+		return fmt.Errorf("address changed again from %s to %s while stabilizing, not updating until it settles", ip, stableIP)
+	}
+	return nil
+}
+
+//holdUntilStable - with stableChecks above 1, whether ip differs from the content published but wasn't detected on stableChecks checks in a row yet.
+//The records then keep their content, so an ip bouncing back and forth isn't pushed (and notified) on every bounce.
+//Checks forced by -force or SIGUSR1 aren't held back.
+func holdUntilStable(configuration *Configuration, state *State, recordType string, ip string) bool {
+	if configuration.StableChecks <= 1 {
+		return false
+	}
+	if !ipChanged(configuration, state, recordType, ip) {
+		state.clearCandidate(recordType)
+		return false
+	}
+	checks := state.observeCandidate(recordType, ip)
+	if checks >= configuration.StableChecks || configuration.forceUpdate {
+		return false
+	}
+	log.Printf("%s address %s detected on %d of %d checks in a row, waiting for it to be stable before updating", recordType, ip, checks, configuration.StableChecks)
+	return true
+}
+
+//ipChanged - whether a record following the detected ip of recordType was last published with another content
+func ipChanged(configuration *Configuration, state *State, recordType string, ip string) bool {
+	for i := range configuration.Records {
+		record := &configuration.Records[i]
+		if !record.followsDetectedIP(recordType, configuration.EnableIPv6) {
+			continue
+		}
+		content, err := record.detectedContent(recordType, ip, configuration.IPv6PrefixLength)
+		if err != nil || state.publishedContent(record, recordType) != content {
+			return true
+		}
+	}
+	return false
+}
+
+//consecutiveFailedChecks - checks failed in a row, reset by the next healthy check
+var consecutiveFailedChecks int
+
+//exitOnPersistentFailure - exits once maxConsecutiveFailures checks failed in a row so a supervisor (systemd, kubernetes) restarts the script.
+//0, the default, never exits.
+func exitOnPersistentFailure(configuration *Configuration) {
+	if configuration.MaxConsecutiveFailures == 0 || consecutiveFailedChecks < configuration.MaxConsecutiveFailures {
+		return
+	}
+	log.Printf("error when checking dns :- %d checks failed in a row, exiting", consecutiveFailedChecks)
+	os.Exit(exitTooManyFailures)
+}
+
+//recordFailedCheck - counts a failed check and sends an error notification once failedChecksBeforeNotifying checks failed in a row.
+//A single notification is sent per streak of failures, so a long outage doesn't send one per interval.
+func recordFailedCheck(ctx context.Context, notifier Notifier, failures []string) {
+	consecutiveFailedChecks++
+	for _, failure := range failures {
+		events.add("error", "%s", failure)
+	}
+	events.add("check", "check failed, %d in a row", consecutiveFailedChecks)
+	if consecutiveFailedChecks == failedChecksBeforeNotifying {
+		//a check aborted by checkTimeoutSeconds is still reported, the requests are bounded by the http timeout
+		notifier.OnError(context.WithoutCancel(ctx), consecutiveFailedChecks, errors.New(strings.Join(failures, "\n")))
+	}
+}
+
+//configFiles - configuration files looked for in the working directory, the first one existing is used
+var configFiles = []string{"config.json", "config.yaml", "config.yml"}
+
+//findConfigFile - the first of configFiles existing, config.json when there is none (environment only configuration)
+func findConfigFile() string {
+	for _, path := range configFiles {
+		_, err := os.Stat(path)
+		if err == nil {
+			return path
+		}
+	}
+	return configFiles[0]
+}
+
+//readConfiguration - loads and validates the file given with -config, or else config.json (or config.yaml) of the working directory.
+//The -dry-run flag overrides the dryRun setting.
+func readConfiguration(configPath string, dryRun bool) (*Configuration, error) {
+	path := configPath
+	if path == "" {
+		path = findConfigFile()
+	}
+	_, statErr := os.Stat(path)
+	//an explicitly given file must exist, falling back to the environment would hide a typo in the path
+	if configPath != "" && os.IsNotExist(statErr) {
+		return nil, fmt.Errorf("%w :- %s doesn't exist", errConfigLoad, configPath)
+	}
+	configuration, err := loadConfig(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w :- %s", errConfigLoad, err.Error())
+	}
+	if dryRun {
+		configuration.DryRun = true
+	}
+	err = configuration.validate()
+	if err != nil && os.IsNotExist(statErr) {
+		return nil, fmt.Errorf("%w :- %s", errConfigNotFound, err.Error())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w :- %s", errConfigInvalid, err.Error())
+	}
+	return &configuration, nil
+}
+
+//exitCodeFor - the exit code for an error returned by readConfiguration
+func exitCodeFor(err error) int {
+	switch {
+	case errors.Is(err, errConfigNotFound):
+		return exitConfigNotFound
+	case errors.Is(err, errConfigLoad):
+		return exitConfigLoad
+	default:
+		return exitConfigInvalid
+	}
+}
+
+//logEffectiveConfiguration - logs the settings the checks run with, so a reload can be verified from the logs
+func logEffectiveConfiguration(configuration *Configuration) {
+	log.Printf("Checking ip every %s", time.Duration(configuration.IntervalSeconds)*time.Second)
+	if splitsIPv6Checks(configuration) {
+		log.Printf("Checking ipv6 every %s", time.Duration(configuration.IPv6IntervalSeconds)*time.Second)
+	}
+	if configuration.IntervalJitterPercent > 0 {
+		log.Printf("with a jitter of up to %d%%", configuration.IntervalJitterPercent)
+	}
+	for _, record := range configuration.Records {
+		zone := record.ZoneIdentifier
+		if zone == "" {
+			zone = record.ZoneName
+		}
+		log.Printf("Keeping record %s in sync (zone %s, proxy %t, ttl %d, ipv6 %t)",
+			record.RecordName, zone, record.proxied(), record.TTL, configuration.EnableIPv6)
+	}
+	if configuration.DryRun {
+		log.Println("dry run mode, no changes will be made to cloudflare")
 	}
 }
 
 func main() {
-	log.Println("Starting DDNS Script")
-	var configuration Configuration
+	configPath := flag.String("config", "", "path of the configuration file, .json or .yaml (default config.json or config.yaml of the working directory)")
+	dryRun := flag.Bool("dry-run", false, "log the changes that would be sent to cloudflare without updating anything")
+	force := flag.Bool("force", false, "push every record on the first check even when it already points at the current ip")
+	once := flag.Bool("once", false, "run a single check and exit, non-zero when it failed (for cron or systemd timers)")
+	pidFile := flag.String("pidfile", "", "write the process id to this file while running, for init systems")
+	printVersion := flag.Bool("version", false, "print the version, git commit and build date and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [status|check|list|verify]\n\n"+
+			"  status\tprint the records currently published in cloudflare and exit\n"+
+			"  check\tcompare the published records with the configuration and exit, non-zero when one is out of sync\n"+
+			"  list\tprint every record of the zones of the configured records and exit\n"+
+			"  verify\tcheck the credentials, the dns edit permission and the configured records exist and exit\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	command := flag.Arg(0)
+	if flag.NArg() > 1 || (command != "" && command != "status" && command != "check" && command != "list" && command != "verify") {
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
 
-	var err error
+	if *printVersion {
+		fmt.Printf("cloudflare-ddns-golang %s (commit %s, built %s)\n", version, commit, buildDate)
+		return
+	}
+
+	log.Printf("Starting DDNS Script %s (commit %s, built %s)", version, commit, buildDate)
 
 	//get configuration
-	file, err := os.Open("config.json")
+	configuration, err := readConfiguration(*configPath, *dryRun)
 	if err != nil {
-		log.Fatalf("error opening config.json :- %s", err.Error())
+		log.Println(err.Error())
+		os.Exit(exitCodeFor(err))
 	}
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&configuration)
+	err = setupLogOutput(configuration)
 	if err != nil {
-		log.Fatalf("error decoding config.json :- %s", err.Error())
+		log.Fatalf("error opening log file :- %s", err.Error())
+	}
+	setupLogFormat(configuration)
+	setupLogLevel(configuration)
+	httpClient.Timeout = time.Duration(configuration.HTTPTimeoutSeconds) * time.Second
+	httpClient.Transport = &userAgentTransport{userAgent: configuration.UserAgent, base: newTransport(configuration)}
+	gatewayClient.Timeout = httpClient.Timeout
+	if configuration.IPSourceAddress != "" {
+		ipv4ProviderClient = newIPProviderClient(configuration, false)
+		ipv6ProviderClient = newIPProviderClient(configuration, true)
+	}
+
+	if command == "status" {
+		os.Exit(runStatusCommand(context.Background(), configuration))
+	}
+	if command == "check" {
+		os.Exit(runCheckCommand(context.Background(), configuration))
+	}
+	if command == "list" {
+		os.Exit(runListCommand(context.Background(), configuration))
+	}
+	if command == "verify" {
+		os.Exit(runVerifyCommand(context.Background(), configuration))
+	}
+	forceNextCheck.Store(*force)
+
+	//single check without the ticker, signal handling or http server
+	if *once {
+		logEffectiveConfiguration(configuration)
+		if !checkAndUpdateDNS(context.Background(), configuration) {
+			log.Println("Ending   DDNS Script, check failed")
+			if authRejected.Load() {
+				os.Exit(exitAuthFailed)
+			}
+			os.Exit(exitCheckFailed)
+		}
+		log.Println("Ending   DDNS Script")
+		return
 	}
-	//Run every 5 mins
-	ticker := time.NewTicker(300000 * time.Millisecond)
+
+	if *pidFile != "" {
+		err = writePIDFile(*pidFile)
+		if err != nil {
+			log.Fatalf("error when writing pid file :- %s", err.Error())
+		}
+		defer removePIDFile(*pidFile)
+	}
+
+	if configuration.ListenAddress != "" {
+		startHTTPServer(configuration)
+	}
+
+	//configuration is swapped on SIGHUP, each check uses the one active when it starts
+	var configurationMutex sync.Mutex
+	activeConfiguration := func() *Configuration {
+		configurationMutex.Lock()
+		defer configurationMutex.Unlock()
+		return configuration
+	}
+
+	//Run every configured interval
+	logEffectiveConfiguration(configuration)
 	done := make(chan bool)
+	//cancelled when an in-progress check doesn't finish within shutdownTimeoutSeconds of a shutdown signal
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	//reconcile right away instead of waiting a full interval after a restart,
+	//credentials rejected on this first check won't start working later so stop instead of retrying forever
+	if !checkAndUpdateDNS(ctx, configuration) && authRejected.Load() {
+		log.Println("error when checking credentials :- cloudflare rejected the configured apiToken or authEmail/authKey")
+		os.Exit(exitAuthFailed)
+	}
+	exitOnPersistentFailure(configuration)
 
+	schedule := newCheckSchedule(configuration)
+	timer := time.NewTimer(schedule.untilNext())
+	var checks sync.WaitGroup
+	checks.Add(1)
 	go func() {
+		defer checks.Done()
 		for {
 			select {
 			case <-done:
 				return
-			case <-ticker.C:
-				checkAndUpdateDNS(&configuration)
+			case <-timer.C:
+				family := schedule.due(time.Now())
+				checkConfiguration := *activeConfiguration()
+				checkConfiguration.checkFamily = family
+				checkAndUpdateDNS(ctx, &checkConfiguration)
+				exitOnPersistentFailure(activeConfiguration())
+				schedule.checked(family, activeConfiguration())
+				//a SIGUSR1 received during the check is still pending, run the forced check now rather than at the next interval
+				if forceNextCheck.Load() {
+					schedule.dueNow()
+					timer.Reset(0)
+					continue
+				}
+				timer.Reset(schedule.untilNext())
 			}
 		}
 	}()
 
-	//Catch Sigterm Signal
+	//Catch Sigterm Signal, reload config.json on SIGHUP, check right away pushing every record on SIGUSR1
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
 	for sig := range c {
 		log.Println(sig.String())
-		ticker.Stop()
-		done <- true
+		if sig == syscall.SIGUSR1 {
+			forceNextCheck.Store(true)
+			schedule.dueNow()
+			timer.Reset(0)
+			continue
+		}
+		if sig == syscall.SIGHUP {
+			//a malformed file keeps the running configuration
+			newConfiguration, err := readConfiguration(*configPath, *dryRun)
+			if err != nil {
+				log.Printf("error when reloading configuration, keeping the current one :- %s", err.Error())
+				continue
+			}
+			configurationMutex.Lock()
+			configuration = newConfiguration
+			configurationMutex.Unlock()
+			setupLogLevel(newConfiguration)
+			setupLogRotation(newConfiguration)
+			schedule.reschedule(newConfiguration)
+			timer.Reset(schedule.untilNext())
+			log.Println("Configuration reloaded, httpTimeoutSeconds, userAgent, listenAddress, logDestination, logFile and logFormat changes need a restart")
+			logEffectiveConfiguration(newConfiguration)
+			continue
+		}
+		timer.Stop()
+		close(done)
+		waitForCheck(&checks, time.Duration(activeConfiguration().ShutdownTimeoutSeconds)*time.Second, cancel)
 		log.Println("Stopped")
 		break
 	}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//testConfiguration - a validated configuration of the single A record home.example.com in zone z1,
+//with its state file in a temporary directory and cloudflare at baseURL
+func testConfiguration(t *testing.T, baseURL string) *Configuration {
+	t.Helper()
+	configuration := &Configuration{
+		APIToken:       "token",
+		ZoneIdentifier: "z1",
+		RecordName:     "home.example.com",
+		APIBaseURL:     baseURL,
+		StateFile:      filepath.Join(t.TempDir(), "state.json"),
+	}
+	err := configuration.validate()
+	if err != nil {
+		t.Fatalf("validate() :- %s", err.Error())
+	}
+	return configuration
+}
+
+//failingDoer - counts the requests sent and fails every one of them
+type failingDoer struct {
+	calls atomic.Int32
+}
+
+func (doer *failingDoer) Do(request *http.Request) (*http.Response, error) {
+	doer.calls.Add(1)
+	return nil, errors.New("network unreachable")
+}
+
+//staticDetector - an ipDetector always returning ip, counting its calls
+func staticDetector(ip string, calls *atomic.Int32) ipDetector {
+	return func(ctx context.Context, configuration *Configuration) (string, error) {
+		calls.Add(1)
+		return ip, nil
+	}
+}
+
+//resetCheckGlobals - forgets what earlier checks of the test binary left behind (cached identifiers, failure streaks)
+func resetCheckGlobals(t *testing.T) {
+	t.Helper()
+	recordIdentifiersMutex.Lock()
+	recordIdentifiers = map[string]cachedRecord{}
+	recordIdentifiersMutex.Unlock()
+	consecutiveFailedChecks = 0
+	cloudflareBreaker = &circuitBreaker{state: circuitClosed}
+	authRejected.Store(false)
+}
+
+func TestRunCheckSurvivesFailures(t *testing.T) {
+	resetCheckGlobals(t)
+	configuration := testConfiguration(t, "http://cloudflare.invalid")
+	doer := &failingDoer{}
+	client := &cloudflareClient{doer: doer, configuration: configuration, baseURL: configuration.APIBaseURL}
+
+	var detections atomic.Int32
+	failingDetector := func(ctx context.Context, configuration *Configuration) (string, error) {
+		detections.Add(1)
+		return "", errors.New("ip provider unreachable")
+	}
+	if runCheck(context.Background(), configuration, client, fanOutNotifier{}, failingDetector, failingDetector) {
+		t.Fatal("check with a failing ip detection reported ok")
+	}
+	if runCheck(context.Background(), configuration, client, fanOutNotifier{}, failingDetector, failingDetector) {
+		t.Fatal("second check with a failing ip detection reported ok")
+	}
+	if detections.Load() != 2 {
+		t.Fatalf("ip detected %d times, want 2", detections.Load())
+	}
+
+	//a detected ip but cloudflare unreachable
+	configuration.MaxRetries = 0
+	var calls atomic.Int32
+	if runCheck(context.Background(), configuration, client, fanOutNotifier{}, staticDetector("203.0.113.7", &calls), failingDetector) {
+		t.Fatal("check with cloudflare unreachable reported ok")
+	}
+	if doer.calls.Load() == 0 {
+		t.Fatal("cloudflare wasn't called")
+	}
+	if consecutiveFailedChecks != 3 {
+		t.Fatalf("%d failed checks counted, want 3", consecutiveFailedChecks)
+	}
+}
+
+func TestUpdateRecordForgetsDeletedRecord(t *testing.T) {
+	resetCheckGlobals(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"success":false,"errors":[{"code":81044,"message":"Record does not exist."}]}`))
+			return
+		}
+		w.Write([]byte(`{"success":true,"result":{"id":"r1","type":"A","name":"home.example.com","content":"198.51.100.1","ttl":120}}`))
+	}))
+	defer server.Close()
+	configuration := testConfiguration(t, server.URL)
+	client := testClient(configuration, server)
+	record := &configuration.Records[0]
+	cacheKey := recordCacheKey(record, "A")
+	cacheRecordIdentifier(cacheKey, "r1")
+
+	_, err := updateRecord(context.Background(), client, fanOutNotifier{}, configuration, record, "A", "203.0.113.7")
+	if !errors.Is(err, errRecordNotFound) {
+		t.Fatalf("updateRecord() :- %v, want errRecordNotFound", err)
+	}
+	if _, cached := cachedRecordIdentifier(cacheKey, time.Hour); cached {
+		t.Error("identifier of the deleted record is still cached")
+	}
+}
+
+func TestDoEveryStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var ticks atomic.Int32
+	done := make(chan struct{})
+	go func() {
+		doEvery(ctx, time.Millisecond, func(time.Time) {
+			if ticks.Add(1) == 3 {
+				cancel()
+			}
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("doEvery didn't return once ctx was cancelled")
+	}
+	stopped := ticks.Load()
+	time.Sleep(10 * time.Millisecond)
+	if ticks.Load() != stopped {
+		t.Errorf("f called %d more times after doEvery returned", ticks.Load()-stopped)
+	}
+	//a tick ready along with the cancellation may still be delivered
+	if stopped < 3 {
+		t.Errorf("f called %d times, want at least 3", stopped)
+	}
+}
+
+func TestGetCurrentIP(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{name: "ip with a trailing newline", status: 200, body: "203.0.113.7\n", want: "203.0.113.7"},
+		{name: "empty body", status: 200, body: ""},
+		{name: "error status", status: 503, body: "203.0.113.7\n"},
+		{name: "not an ip", status: 200, body: "<html>rate limited</html>"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+			configuration := testConfiguration(t, "http://cloudflare.invalid")
+			configuration.IPProviders = []string{server.URL}
+
+			ip, err := getCurrentIP(context.Background(), configuration)
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("getCurrentIP() returned %q, want an error", ip)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getCurrentIP() :- %s", err.Error())
+			}
+			if ip != test.want {
+				t.Errorf("getCurrentIP() returned %q, want %q", ip, test.want)
+			}
+		})
+	}
+}
+
+func TestRunCheckUnchangedIPSkipsCloudflare(t *testing.T) {
+	resetCheckGlobals(t)
+	configuration := testConfiguration(t, "http://cloudflare.invalid")
+	configuration.EnableIPv6 = true
+	record := &configuration.Records[0]
+	state, err := loadState(configuration.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.setPublished(record, "A", "203.0.113.7")
+	state.setPublished(record, "AAAA", "2001:db8::7")
+	err = saveState(configuration.StateFile, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doer := &failingDoer{}
+	client := &cloudflareClient{doer: doer, configuration: configuration, baseURL: configuration.APIBaseURL}
+	var ipv4Detections, ipv6Detections atomic.Int32
+	ok := runCheck(context.Background(), configuration, client, fanOutNotifier{},
+		staticDetector("203.0.113.7", &ipv4Detections), staticDetector("2001:db8::7", &ipv6Detections))
+	if !ok {
+		t.Fatal("check of unchanged ips reported a failure")
+	}
+	if ipv4Detections.Load() != 1 || ipv6Detections.Load() != 1 {
+		t.Errorf("ipv4 detected %d times and ipv6 %d times, want once each", ipv4Detections.Load(), ipv6Detections.Load())
+	}
+	if doer.calls.Load() != 0 {
+		t.Errorf("%d cloudflare requests sent, want none", doer.calls.Load())
+	}
+}
+
+//apiCall - request received by the fake cloudflare api
+type apiCall struct {
+	method string
+	path   string
+	query  string
+	body   string
+}
+
+func TestRunCheckUpdatesRecord(t *testing.T) {
+	resetCheckGlobals(t)
+	var mutex sync.Mutex
+	var calls []apiCall
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		calls = append(calls, apiCall{method: r.Method, path: r.URL.Path, query: r.URL.RawQuery, body: string(body)})
+		mutex.Unlock()
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/zones/z1/dns_records":
+			w.Write([]byte(`{"success":true,"result":[{"id":"r1","type":"A","name":"home.example.com","content":"198.51.100.1","proxied":false,"ttl":120}],` +
+				`"result_info":{"page":1,"per_page":100,"total_pages":1,"count":1,"total_count":1}}`))
+		case r.Method == "PUT" && r.URL.Path == "/zones/z1/dns_records/r1":
+			w.Write([]byte(`{"success":true,"result":{"id":"r1","type":"A","name":"home.example.com","content":"203.0.113.7","proxied":false,"ttl":120}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"success":false,"errors":[{"code":7003,"message":"No route for that URI"}]}`))
+		}
+	}))
+	defer server.Close()
+	configuration := testConfiguration(t, server.URL)
+	var detections atomic.Int32
+	detector := staticDetector("203.0.113.7", &detections)
+
+	if !runCheck(context.Background(), configuration, newCloudflareClient(configuration), fanOutNotifier{}, detector, detector) {
+		t.Fatal("first check failed")
+	}
+	if len(calls) != 2 {
+		t.Fatalf("%d api calls %+v, want the lookup and the update", len(calls), calls)
+	}
+	lookup, update := calls[0], calls[1]
+	if lookup.method != "GET" || lookup.path != "/zones/z1/dns_records" || lookup.query != "page=1&per_page=100&name=home.example.com&type=A" {
+		t.Errorf("lookup %+v", lookup)
+	}
+	if update.method != "PUT" || update.path != "/zones/z1/dns_records/r1" {
+		t.Errorf("update %+v", update)
+	}
+	var sent map[string]interface{}
+	err := json.Unmarshal([]byte(update.body), &sent)
+	if err != nil {
+		t.Fatalf("update body %q :- %s", update.body, err.Error())
+	}
+	want := map[string]interface{}{"id": "z1", "type": "A", "name": "home.example.com", "content": "203.0.113.7", "proxied": false, "ttl": float64(120)}
+	if len(sent) != len(want) {
+		t.Errorf("update body %s, want %v", update.body, want)
+	}
+	for key, value := range want {
+		if sent[key] != value {
+			t.Errorf("update body %s = %v, want %v", key, sent[key], value)
+		}
+	}
+
+	calls = nil
+	if !runCheck(context.Background(), configuration, newCloudflareClient(configuration), fanOutNotifier{}, detector, detector) {
+		t.Fatal("second check failed")
+	}
+	if len(calls) != 0 {
+		t.Errorf("second check of the same ip made the api calls %+v, want none", calls)
+	}
+}
+
+func TestRunCheckDryRunLeavesStateAlone(t *testing.T) {
+	resetCheckGlobals(t)
+	configuration := testConfiguration(t, "http://cloudflare.invalid")
+	configuration.DryRun = true
+	configuration.StableChecks = 2
+	doer := &failingDoer{}
+	client := &cloudflareClient{doer: doer, configuration: configuration, baseURL: configuration.APIBaseURL}
+	var detections atomic.Int32
+
+	//the new ip is held back as a candidate, which would otherwise be saved
+	if !runCheck(context.Background(), configuration, client, fanOutNotifier{}, staticDetector("203.0.113.7", &detections), nil) {
+		t.Fatal("dry run check failed")
+	}
+	if _, err := os.Stat(configuration.StateFile); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote %s :- %v", configuration.StateFile, err)
+	}
+	if doer.calls.Load() != 0 {
+		t.Errorf("%d cloudflare requests sent, want none", doer.calls.Load())
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Metrics - counters and gauges describing what the updater has been doing, exposed in the prometheus text format
+type Metrics struct {
+	mutex                sync.Mutex
+	updatesSucceeded     uint64
+	updatesFailed        uint64
+	ipDetectionFailures  uint64
+	unchangedChecks      uint64
+	lastSuccessfulUpdate time.Time
+	lastHealthyCheck     time.Time
+	lastCheck            time.Time
+	publishedIPs         map[string]string
+	detectedIPs          map[string]string
+	previousIPs          map[string]string
+	records              map[string]recordStatus
+}
+
+//recordStatus - outcome of the last check of a record, served on /status
+type recordStatus struct {
+	RecordName string    `json:"name"`
+	RecordType string    `json:"type"`
+	Content    string    `json:"content"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+//statusResponse - JSON body of /status
+type statusResponse struct {
+	CurrentIPs           map[string]string `json:"currentIps"`
+	PreviousIPs          map[string]string `json:"previousIps"`
+	PublishedIPs         map[string]string `json:"publishedIps"`
+	LastCheck            *time.Time        `json:"lastCheck"`
+	LastSuccessfulUpdate *time.Time        `json:"lastSuccessfulUpdate"`
+	Records              []recordStatus    `json:"records"`
+}
+
+//metrics - shared by checkAndUpdateDNS and the http server.
+//The daemon counts as healthy from startup until the first check completes.
+var metrics = &Metrics{
+	publishedIPs:     map[string]string{},
+	detectedIPs:      map[string]string{},
+	previousIPs:      map[string]string{},
+	records:          map[string]recordStatus{},
+	lastHealthyCheck: time.Now(),
+}
+
+//recordUpdate - counts a record successfully pointed at a new ip
+func (m *Metrics) recordUpdate() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.updatesSucceeded++
+	m.lastSuccessfulUpdate = time.Now()
+}
+
+//recordUpdateFailure - counts a record that failed to update
+func (m *Metrics) recordUpdateFailure() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.updatesFailed++
+}
+
+//recordIPDetectionFailure - counts a check where the public ip couldn't be detected
+func (m *Metrics) recordIPDetectionFailure() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.ipDetectionFailures++
+}
+
+//recordUnchanged - counts a check where the ip didn't change
+func (m *Metrics) recordUnchanged() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.unchangedChecks++
+}
+
+//setPublishedIP - remembers the ip currently published for the record type (A or AAAA)
+func (m *Metrics) setPublishedIP(recordType string, ip string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.publishedIPs[recordType] = ip
+}
+
+//setDetectedIP - remembers the ip detected for the record type (A or AAAA), and the one detected before it changed
+func (m *Metrics) setDetectedIP(recordType string, ip string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if previousIP := m.detectedIPs[recordType]; previousIP != "" && previousIP != ip {
+		m.previousIPs[recordType] = previousIP
+		events.add("ip", "detected %s address changed from %s to %s", recordType, previousIP, ip)
+	}
+	m.detectedIPs[recordType] = ip
+}
+
+//setRecordResult - remembers the outcome of checking the record, unchanged, updated or failed when err is set
+func (m *Metrics) setRecordResult(record *RecordConfig, recordType string, content string, updated bool, err error) {
+	status := recordStatus{
+		RecordName: record.RecordName,
+		RecordType: recordType,
+		Content:    content,
+		Result:     "unchanged",
+		Time:       time.Now(),
+	}
+	if updated {
+		status.Result = "updated"
+	}
+	if err != nil {
+		status.Result = "failed"
+		status.Error = err.Error()
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.records[recordCacheKey(record, recordType)] = status
+}
+
+//recordCheck - remembers when the last check ran, whatever its outcome
+func (m *Metrics) recordCheck() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.lastCheck = time.Now()
+}
+
+//recordHealthyCheck - remembers that a check completed without errors, whether the ip changed or not
+func (m *Metrics) recordHealthyCheck() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.lastHealthyCheck = time.Now()
+}
+
+//healthHandler - returns 200 while the last healthy check is within threshold and 503 once the daemon has been failing for longer
+func (m *Metrics) healthHandler(threshold time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.mutex.Lock()
+		sinceHealthy := time.Since(m.lastHealthyCheck)
+		m.mutex.Unlock()
+
+		if sinceHealthy > threshold {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "unhealthy, last successful check %s ago\n", sinceHealthy.Round(time.Second))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+//ServeHTTP - writes the metrics in the prometheus text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "ddns_updates_total", "counter", "Number of dns records successfully updated.", m.updatesSucceeded)
+	writeMetric(w, "ddns_update_failures_total", "counter", "Number of dns record updates that failed.", m.updatesFailed)
+	writeMetric(w, "ddns_ip_detection_failures_total", "counter", "Number of checks where the public ip couldn't be detected.", m.ipDetectionFailures)
+	writeMetric(w, "ddns_unchanged_checks_total", "counter", "Number of checks where the public ip hadn't changed.", m.unchangedChecks)
+
+	var lastSuccess int64
+	if !m.lastSuccessfulUpdate.IsZero() {
+		lastSuccess = m.lastSuccessfulUpdate.Unix()
+	}
+	writeMetric(w, "ddns_last_successful_update_timestamp_seconds", "gauge", "Unix time of the last successful dns record update.", lastSuccess)
+
+	fmt.Fprintln(w, "# HELP ddns_published_ip_info Public ip currently published, by record type.")
+	fmt.Fprintln(w, "# TYPE ddns_published_ip_info gauge")
+	recordTypes := make([]string, 0, len(m.publishedIPs))
+	for recordType := range m.publishedIPs {
+		recordTypes = append(recordTypes, recordType)
+	}
+	sort.Strings(recordTypes)
+	for _, recordType := range recordTypes {
+		fmt.Fprintf(w, "ddns_published_ip_info{type=%q,ip=%q} 1\n", recordType, m.publishedIPs[recordType])
+	}
+}
+
+//statusHandler - serves the detected and published ips, the time of the last check and update and the result of each record as JSON
+func (m *Metrics) statusHandler(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	status := statusResponse{
+		CurrentIPs:   copyMap(m.detectedIPs),
+		PreviousIPs:  copyMap(m.previousIPs),
+		PublishedIPs: copyMap(m.publishedIPs),
+		Records:      make([]recordStatus, 0, len(m.records)),
+	}
+	if !m.lastCheck.IsZero() {
+		lastCheck := m.lastCheck
+		status.LastCheck = &lastCheck
+	}
+	if !m.lastSuccessfulUpdate.IsZero() {
+		lastSuccessfulUpdate := m.lastSuccessfulUpdate
+		status.LastSuccessfulUpdate = &lastSuccessfulUpdate
+	}
+	keys := make([]string, 0, len(m.records))
+	for key := range m.records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		status.Records = append(status.Records, m.records[key])
+	}
+	m.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(status)
+	if err != nil {
+		log.Printf("error when serving /status :- %s", err.Error())
+	}
+}
+
+//copyMap - copy of a map guarded by the metrics mutex, safe to use once it is released
+func copyMap(values map[string]string) map[string]string {
+	valuesCopy := make(map[string]string, len(values))
+	for key, value := range values {
+		valuesCopy[key] = value
+	}
+	return valuesCopy
+}
+
+//writeMetric - writes a single sample with its HELP and TYPE lines
+func writeMetric(w io.Writer, name string, metricType string, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, metricType, name, value)
+}
+
+//startHTTPServer - serves /metrics, /healthz, /status and /events on the configured listen address in the background
+func startHTTPServer(configuration *Configuration) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	mux.Handle("/healthz", metrics.healthHandler(time.Duration(configuration.HealthThresholdSeconds)*time.Second))
+	mux.HandleFunc("/status", metrics.statusHandler)
+	mux.HandleFunc("/events", eventsHandler)
+
+	go func() {
+		log.Printf("Serving /metrics, /healthz, /status and /events on %s", configuration.ListenAddress)
+		err := http.ListenAndServe(configuration.ListenAddress, mux)
+		if err != nil {
+			log.Printf("error when serving http :- %s", err.Error())
+		}
+	}()
+}
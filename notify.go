@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//webhookNotification - JSON payload posted to notifyWebhookURL when a record is updated
+type webhookNotification struct {
+	RecordName string    `json:"record"`
+	RecordType string    `json:"type"`
+	OldIP      string    `json:"oldIp"`
+	NewIP      string    `json:"newIp"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+//discordEmbed - embed of a discord webhook message
+type discordEmbed struct {
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Color       int       `json:"color"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+//discordMessage - JSON payload posted to discordWebhookURL when a record is updated
+type discordMessage struct {
+	Embeds []discordEmbed `json:"embeds"`
+}
+
+//slackMessage - JSON payload posted to slackWebhookURL
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+//telegramMessage - JSON payload posted to the sendMessage method of the telegram bot api
+type telegramMessage struct {
+	ChatID string `json:"chat_id"`
+	Text   string `json:"text"`
+}
+
+//Notifier - a notification backend, told when a record was created (empty oldContent) or updated
+//and when failedChecksBeforeNotifying checks failed in a row.
+//Notifying is best effort, implementations only log their failures so they never fail the update itself.
+type Notifier interface {
+	OnUpdate(ctx context.Context, record *RecordConfig, recordType string, oldContent string, newContent string)
+	OnError(ctx context.Context, failedChecks int, err error)
+}
+
+//fanOutNotifier - notifies every configured backend in turn
+type fanOutNotifier []Notifier
+
+//newNotifier - builds a notifier for every backend set up in the configuration
+func newNotifier(configuration *Configuration) Notifier {
+	var notifiers fanOutNotifier
+	if configuration.NotifyWebhookURL != "" {
+		notifiers = append(notifiers, &webhookNotifier{url: configuration.NotifyWebhookURL})
+	}
+	if configuration.DiscordWebhookURL != "" {
+		notifiers = append(notifiers, &discordNotifier{url: configuration.DiscordWebhookURL})
+	}
+	if configuration.SlackWebhookURL != "" {
+		notifiers = append(notifiers, &slackNotifier{url: configuration.SlackWebhookURL})
+	}
+	if configuration.TelegramBotToken != "" && configuration.TelegramChatID != "" {
+		notifiers = append(notifiers, &telegramNotifier{botToken: configuration.TelegramBotToken, chatID: configuration.TelegramChatID})
+	}
+	if configuration.SMTPHost != "" && configuration.SMTPFrom != "" && len(configuration.SMTPTo) > 0 {
+		notifiers = append(notifiers, &emailNotifier{configuration: configuration})
+	}
+	return notifiers
+}
+
+//OnUpdate - tells every notifier about the change
+func (notifiers fanOutNotifier) OnUpdate(ctx context.Context, record *RecordConfig, recordType string, oldContent string, newContent string) {
+	for _, notifier := range notifiers {
+		notifier.OnUpdate(ctx, record, recordType, oldContent, newContent)
+	}
+}
+
+//OnError - tells every notifier about the failures
+func (notifiers fanOutNotifier) OnError(ctx context.Context, failedChecks int, err error) {
+	for _, notifier := range notifiers {
+		notifier.OnError(ctx, failedChecks, err)
+	}
+}
+
+//updateSummary - one line description of a change, for the text based notifiers
+func updateSummary(record *RecordConfig, recordType string, oldContent string, newContent string) string {
+	if oldContent == "" {
+		return fmt.Sprintf("%s record %s created with %s", recordType, record.RecordName, newContent)
+	}
+	return fmt.Sprintf("%s record %s changed from %s to %s", recordType, record.RecordName, oldContent, newContent)
+}
+
+//errorSummary - description of repeated failures, for the text based notifiers
+func errorSummary(failedChecks int, err error) string {
+	return fmt.Sprintf("DDNS update failing, %d checks in a row failed :-\n%s", failedChecks, err.Error())
+}
+
+//webhookNotifier - posts the change as a webhookNotification to notifyWebhookURL
+type webhookNotifier struct {
+	url string
+}
+
+//OnUpdate - posts the change to the webhook
+func (notifier *webhookNotifier) OnUpdate(ctx context.Context, record *RecordConfig, recordType string, oldContent string, newContent string) {
+	postNotification(ctx, "webhook", notifier.url, webhookNotification{
+		RecordName: record.RecordName,
+		RecordType: recordType,
+		OldIP:      oldContent,
+		NewIP:      newContent,
+		Timestamp:  time.Now().UTC(),
+	})
+}
+
+//OnError - the webhook payload only describes changes
+func (notifier *webhookNotifier) OnError(ctx context.Context, failedChecks int, err error) {}
+
+//discordNotifier - posts the change as an embed to discordWebhookURL
+type discordNotifier struct {
+	url string
+}
+
+//OnUpdate - posts the change to the discord webhook
+func (notifier *discordNotifier) OnUpdate(ctx context.Context, record *RecordConfig, recordType string, oldContent string, newContent string) {
+	description := fmt.Sprintf("%s record **%s** created with %s", recordType, record.RecordName, newContent)
+	if oldContent != "" {
+		description = fmt.Sprintf("%s record **%s** changed from %s to %s", recordType, record.RecordName, oldContent, newContent)
+	}
+	postNotification(ctx, "discord", notifier.url, discordMessage{
+		Embeds: []discordEmbed{{
+			Title:       "DDNS record updated",
+			Description: description,
+			Color:       0xf38020,
+			Timestamp:   time.Now().UTC(),
+		}},
+	})
+}
+
+//OnError - discord is only told about changes
+func (notifier *discordNotifier) OnError(ctx context.Context, failedChecks int, err error) {}
+
+//slackNotifier - posts messages to slackWebhookURL
+type slackNotifier struct {
+	url string
+}
+
+//OnUpdate - posts the change to slack
+func (notifier *slackNotifier) OnUpdate(ctx context.Context, record *RecordConfig, recordType string, oldContent string, newContent string) {
+	postNotification(ctx, "slack", notifier.url, slackMessage{Text: ":white_check_mark: " + updateSummary(record, recordType, oldContent, newContent)})
+}
+
+//OnError - posts an alert to slack
+func (notifier *slackNotifier) OnError(ctx context.Context, failedChecks int, err error) {
+	postNotification(ctx, "slack", notifier.url, slackMessage{Text: ":rotating_light: " + errorSummary(failedChecks, err)})
+}
+
+//telegramNotifier - sends messages to telegramChatID through the bot api
+type telegramNotifier struct {
+	botToken string
+	chatID   string
+}
+
+//OnUpdate - sends the change to the telegram chat
+func (notifier *telegramNotifier) OnUpdate(ctx context.Context, record *RecordConfig, recordType string, oldContent string, newContent string) {
+	notifier.send(ctx, updateSummary(record, recordType, oldContent, newContent))
+}
+
+//OnError - sends the failures to the telegram chat
+func (notifier *telegramNotifier) OnError(ctx context.Context, failedChecks int, err error) {
+	notifier.send(ctx, errorSummary(failedChecks, err))
+}
+
+//send - posts text to the sendMessage method of the bot api
+func (notifier *telegramNotifier) send(ctx context.Context, text string) {
+	postNotification(ctx, "telegram", "https://api.telegram.org/bot"+notifier.botToken+"/sendMessage", telegramMessage{
+		ChatID: notifier.chatID,
+		Text:   text,
+	})
+}
+
+//emailNotifier - emails changes to smtpTo through the configured smtp server
+type emailNotifier struct {
+	configuration *Configuration
+}
+
+//OnUpdate - emails the change
+func (notifier *emailNotifier) OnUpdate(ctx context.Context, record *RecordConfig, recordType string, oldContent string, newContent string) {
+	configuration := notifier.configuration
+	subject := fmt.Sprintf("DDNS %s record %s updated to %s", recordType, record.RecordName, newContent)
+	body := fmt.Sprintf("The %s record %s was created with %s.", recordType, record.RecordName, newContent)
+	if oldContent != "" {
+		body = fmt.Sprintf("The %s record %s changed from %s to %s.", recordType, record.RecordName, oldContent, newContent)
+	}
+	message := "From: " + configuration.SMTPFrom + "\r\n" +
+		"To: " + strings.Join(configuration.SMTPTo, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + body + "\r\n"
+
+	err := sendEmail(ctx, configuration, message)
+	if err != nil {
+		log.Printf("error when sending email notification :- %s", err.Error())
+	}
+}
+
+//OnError - email is only sent for changes
+func (notifier *emailNotifier) OnError(ctx context.Context, failedChecks int, err error) {}
+
+//sendEmail - delivers message through the configured smtp server.
+//STARTTLS is used whenever the server offers it, and credentials are only sent over an encrypted connection.
+func sendEmail(ctx context.Context, configuration *Configuration, message string) error {
+	address := net.JoinHostPort(configuration.SMTPHost, strconv.Itoa(configuration.SMTPPort))
+	conn, err := (&net.Dialer{Timeout: httpClient.Timeout}).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	//bounds the whole smtp exchange, net/smtp has no timeouts of its own
+	conn.SetDeadline(time.Now().Add(httpClient.Timeout))
+
+	client, err := smtp.NewClient(conn, configuration.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: configuration.SMTPHost})
+		if err != nil {
+			return fmt.Errorf("error when starting tls :- %s", err.Error())
+		}
+	}
+	if configuration.SMTPUsername != "" {
+		//PlainAuth refuses to send the password over a connection that isn't encrypted (except to localhost)
+		err = client.Auth(smtp.PlainAuth("", configuration.SMTPUsername, configuration.SMTPPassword, configuration.SMTPHost))
+		if err != nil {
+			return fmt.Errorf("error when authenticating :- %s", err.Error())
+		}
+	}
+
+	err = client.Mail(configuration.SMTPFrom)
+	if err != nil {
+		return err
+	}
+	for _, to := range configuration.SMTPTo {
+		err = client.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write([]byte(message))
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+//postNotification - posts payload as JSON to notificationURL, logging any failure against the named service
+func postNotification(ctx context.Context, service string, notificationURL string, payload interface{}) {
+	notificationJSON, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("error when sending %s notification :- %s", service, err.Error())
+		return
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", notificationURL, bytes.NewBuffer(notificationJSON))
+	if err != nil {
+		log.Printf("error when sending %s notification :- %s", service, err.Error())
+		return
+	}
+	request.Header.Add("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(request)
+	if err != nil {
+		//the url holds secrets (webhook or bot tokens), only log the cause
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		log.Printf("error when sending %s notification :- %s", service, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("error when sending %s notification :- %s returned %s", service, service, resp.Status)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+//ip families a check can be limited to
+const (
+	familyAll  = ""     //every record
+	familyIPv4 = "ipv4" //the A records and the records with a fixed content
+	familyIPv6 = "ipv6" //the AAAA records following the detected ipv6 address
+)
+
+//checkSchedule - when the next checks are due. With an ipv6IntervalSeconds of its own the AAAA records are checked
+//on their own schedule, a family due alone is checked without the other one.
+//Every check runs from the same loop, so the families never race on the state file.
+type checkSchedule struct {
+	mutex   sync.Mutex
+	split   bool
+	ipv4Due time.Time
+	ipv6Due time.Time
+}
+
+//newCheckSchedule - plans the first checks after the one run on startup
+func newCheckSchedule(configuration *Configuration) *checkSchedule {
+	schedule := &checkSchedule{}
+	schedule.reschedule(configuration)
+	return schedule
+}
+
+//splitsIPv6Checks - whether the AAAA records are checked on their own interval, only when a record follows the ipv6 address
+func splitsIPv6Checks(configuration *Configuration) bool {
+	return configuration.IPv6IntervalSeconds != configuration.IntervalSeconds && needsDetectedIP(configuration, "AAAA")
+}
+
+//reschedule - plans the next check of every family from now, on startup and when the configuration is reloaded
+func (schedule *checkSchedule) reschedule(configuration *Configuration) {
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+	now := time.Now()
+	schedule.split = splitsIPv6Checks(configuration)
+	schedule.ipv4Due = now.Add(nextCheckDelay(configuration, familyIPv4))
+	schedule.ipv6Due = now.Add(nextCheckDelay(configuration, familyIPv6))
+}
+
+//dueNow - makes every family due, for a check forced with SIGUSR1
+func (schedule *checkSchedule) dueNow() {
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+	now := time.Now()
+	schedule.ipv4Due = now
+	schedule.ipv6Due = now
+}
+
+//untilNext - delay until the next family is due, to reset the timer with
+func (schedule *checkSchedule) untilNext() time.Duration {
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+	next := schedule.ipv4Due
+	if schedule.split && schedule.ipv6Due.Before(next) {
+		next = schedule.ipv6Due
+	}
+	return time.Until(next)
+}
+
+//due - the family to check at now, familyAll when both are due or the checks aren't split
+func (schedule *checkSchedule) due(now time.Time) string {
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+	if !schedule.split {
+		return familyAll
+	}
+	ipv4Due := !now.Before(schedule.ipv4Due)
+	ipv6Due := !now.Before(schedule.ipv6Due)
+	if ipv4Due && !ipv6Due {
+		return familyIPv4
+	}
+	if ipv6Due && !ipv4Due {
+		return familyIPv6
+	}
+	return familyAll
+}
+
+//checked - plans the next check of the family just checked, the delay is computed again every time to apply the jitter
+func (schedule *checkSchedule) checked(family string, configuration *Configuration) {
+	schedule.mutex.Lock()
+	defer schedule.mutex.Unlock()
+	now := time.Now()
+	if family != familyIPv6 {
+		schedule.ipv4Due = now.Add(nextCheckDelay(configuration, familyIPv4))
+	}
+	if family != familyIPv4 {
+		schedule.ipv6Due = now.Add(nextCheckDelay(configuration, familyIPv6))
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//recordState - content, proxied flag, ttl and priority last published to cloudflare for a record, and when
+type recordState struct {
+	Content   string    `json:"content"`
+	Proxied   bool      `json:"proxied"`
+	TTL       int       `json:"ttl"`
+	Priority  int       `json:"priority,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+//ipCandidate - detected ip not published yet, and on how many checks in a row it was detected (see stableChecks)
+type ipCandidate struct {
+	IP        string    `json:"ip"`
+	Checks    int       `json:"checks"`
+	FirstSeen time.Time `json:"firstSeen"`
+}
+
+//State - contents published for every record, persisted in stateFile so unchanged records don't need a request to cloud flare after a restart.
+//Records are keyed by record name and type (see stateKey), candidates by record type (A or AAAA).
+type State struct {
+	Records    map[string]recordState `json:"records"`
+	Candidates map[string]ipCandidate `json:"candidates,omitempty"`
+	changed    bool
+	//records are checked concurrently
+	mutex sync.Mutex
+}
+
+//stateKey - key of the record in State.Records
+func stateKey(record *RecordConfig, recordType string) string {
+	return record.RecordName + "/" + recordType
+}
+
+//publishedContent - content last published for the record, empty when it was never published
+func (state *State) publishedContent(record *RecordConfig, recordType string) string {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.Records[stateKey(record, recordType)].Content
+}
+
+//isPublished - whether content was last published for the record with its current proxy, ttl and priority settings,
+//so changing them in the configuration updates the record even when the ip didn't change
+func (state *State) isPublished(record *RecordConfig, recordType string, content string) bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	published := state.Records[stateKey(record, recordType)]
+	return published.Content == content && published.Proxied == record.proxied() && published.TTL == int(record.TTL) &&
+		published.Priority == record.priority()
+}
+
+//setPublished - remembers content was published for the record with its proxy, ttl and priority settings, to be written by saveState
+func (state *State) setPublished(record *RecordConfig, recordType string, content string) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.Records[stateKey(record, recordType)] = recordState{
+		Content:   content,
+		Proxied:   record.proxied(),
+		TTL:       int(record.TTL),
+		Priority:  record.priority(),
+		UpdatedAt: time.Now().UTC(),
+	}
+	state.changed = true
+}
+
+//observeCandidate - counts ip as detected on one more check in a row, a different ip starts counting again.
+//Returns the checks ip was detected on.
+func (state *State) observeCandidate(recordType string, ip string) int {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if state.Candidates == nil {
+		state.Candidates = map[string]ipCandidate{}
+	}
+	candidate := state.Candidates[recordType]
+	if candidate.IP != ip {
+		candidate = ipCandidate{IP: ip, FirstSeen: time.Now().UTC()}
+	}
+	candidate.Checks++
+	state.Candidates[recordType] = candidate
+	state.changed = true
+	return candidate.Checks
+}
+
+//clearCandidate - forgets the candidate ip of the record type once the published one is detected again
+func (state *State) clearCandidate(recordType string) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if _, found := state.Candidates[recordType]; found {
+		delete(state.Candidates, recordType)
+		state.changed = true
+	}
+}
+
+//loadState - reads the state file, a missing (first run) or corrupt file is an empty state
+func loadState(path string) (*State, error) {
+	state := &State{Records: map[string]recordState{}}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s :- %s", path, err.Error())
+	}
+	defer file.Close()
+
+	//an empty or truncated file (e.g. written by a version without atomic writes) only costs a comparison with the live records
+	err = json.NewDecoder(file).Decode(state)
+	if err != nil {
+		log.Printf("error decoding %s, starting from an empty state :- %s", path, err.Error())
+		return &State{Records: map[string]recordState{}}, nil
+	}
+	if state.Records == nil {
+		state.Records = map[string]recordState{}
+	}
+	return state, nil
+}
+
+//saveState - writes the state to path atomically, see writeFileAtomic
+func saveState(path string, state *State) error {
+	stateJSON, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding state :- %s", err.Error())
+	}
+
+	err = writeFileAtomic(path, stateJSON, 0644)
+	if err != nil {
+		return fmt.Errorf("error when writing to %s :- %s", path, err.Error())
+	}
+	state.changed = false
+	return nil
+}
+
+//writeFileAtomic - writes data to a temporary file in the same directory, flushes it to disk and renames it over path.
+//The rename is atomic on POSIX filesystems, so a crash mid-write leaves either the previous or the new file, never a partial one.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	//no-op once the rename succeeded
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Chmod(perm)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	//persist the rename itself, best effort as not every platform can sync a directory
+	dir, err := os.Open(filepath.Dir(path))
+	if err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
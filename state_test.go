@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateRecoversFromInterruptedWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	//what a crash mid-write of an older version leaves behind, a truncated file and a temporary file never renamed
+	err := os.WriteFile(path, []byte(`{"records":{"home.example.com/A":{"content":"198.51`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "state.json.tmp123"), []byte(`{"records":`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := loadState(path)
+	if err != nil {
+		t.Fatalf("loadState() :- %s", err.Error())
+	}
+	if len(state.Records) != 0 {
+		t.Fatalf("state of a truncated file has %d records, want none", len(state.Records))
+	}
+
+	record := &RecordConfig{RecordName: "home.example.com", TTL: 120}
+	state.setPublished(record, "A", "203.0.113.7")
+	err = saveState(path, state)
+	if err != nil {
+		t.Fatalf("saveState() :- %s", err.Error())
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved State
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		t.Fatalf("saved state isn't valid JSON :- %s", err.Error())
+	}
+	if saved.Records["home.example.com/A"].Content != "203.0.113.7" {
+		t.Errorf("saved state %+v", saved.Records)
+	}
+
+	//the stray file is left alone, the write used a temporary file of its own and renamed it
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != 2 || names[0] != "state.json" || names[1] != "state.json.tmp123" {
+		t.Errorf("files left after saveState %q, want state.json and the stray state.json.tmp123", names)
+	}
+
+	reloaded, err := loadState(path)
+	if err != nil {
+		t.Fatalf("loadState() :- %s", err.Error())
+	}
+	if !reloaded.isPublished(record, "A", "203.0.113.7") {
+		t.Error("reloaded state doesn't have the record published")
+	}
+}
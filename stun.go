@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+//defaultSTUNServer - stun server asked when stunServer isn't set
+const defaultSTUNServer = "stun.l.google.com:19302"
+
+//stunTimeout - how long to wait for the stun server to answer, the request is sent again every stunRetransmit meanwhile
+const stunTimeout = 3 * time.Second
+
+//stunRetransmit - stun runs over udp, a request or response lost on the way is sent again
+const stunRetransmit = 500 * time.Millisecond
+
+//stun message fields (RFC 5389)
+const (
+	stunBindingRequest       = 0x0001
+	stunBindingSuccess       = 0x0101
+	stunMagicCookie          = 0x2112A442
+	stunHeaderLength         = 20
+	stunAttrMappedAddress    = 0x0001
+	stunAttrXORMappedAddress = 0x0020
+	stunFamilyIPv4           = 0x01
+	stunFamilyIPv6           = 0x02
+)
+
+//getIPFromSTUN - sends a stun binding request to server and returns the reflexive address it saw the request coming from,
+//the public address of the nat in front of the host. The request is sent from the ipSourceAddress of the family when set.
+func getIPFromSTUN(ctx context.Context, configuration *Configuration, ipv6 bool) (string, error) {
+	network := "udp4"
+	if ipv6 {
+		network = "udp6"
+	}
+	dialer := &net.Dialer{}
+	if configuration.IPSourceAddress != "" {
+		localIP, err := sourceAddress(configuration.IPSourceAddress, ipv6)
+		if err != nil {
+			return "", err
+		}
+		dialer.LocalAddr = &net.UDPAddr{IP: localIP}
+	}
+	conn, err := dialer.DialContext(ctx, network, configuration.STUNServer)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(stunTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	request := make([]byte, stunHeaderLength)
+	binary.BigEndian.PutUint16(request[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:8], stunMagicCookie)
+	_, err = rand.Read(request[8:20])
+	if err != nil {
+		return "", err
+	}
+	transactionID := request[8:20]
+
+	response := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		_, err = conn.Write(request)
+		if err != nil {
+			return "", err
+		}
+		readDeadline := time.Now().Add(stunRetransmit)
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		conn.SetReadDeadline(readDeadline)
+
+		for {
+			length, err := conn.Read(response)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return "", err
+			}
+			ip, err := parseSTUNResponse(response[:length], transactionID)
+			if err == errSTUNOtherTransaction {
+				//a late answer to an earlier check or a stray packet
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+			if (ip.To4() == nil) != ipv6 {
+				return "", fmt.Errorf("stun server %s returned %s, not an address of the family asked", configuration.STUNServer, ip)
+			}
+			return ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("stun server %s didn't answer within %s", configuration.STUNServer, stunTimeout)
+}
+
+//errSTUNOtherTransaction - the message isn't the answer to the request sent
+var errSTUNOtherTransaction = errors.New("stun message of another transaction")
+
+//parseSTUNResponse - the mapped address of a binding success response, XOR-MAPPED-ADDRESS or MAPPED-ADDRESS for old servers
+func parseSTUNResponse(message []byte, transactionID []byte) (net.IP, error) {
+	if len(message) < stunHeaderLength || binary.BigEndian.Uint32(message[4:8]) != stunMagicCookie {
+		return nil, errors.New("invalid stun response")
+	}
+	if !bytes.Equal(message[8:20], transactionID) {
+		return nil, errSTUNOtherTransaction
+	}
+	if binary.BigEndian.Uint16(message[0:2]) != stunBindingSuccess {
+		return nil, fmt.Errorf("stun binding request failed, message type 0x%04x", binary.BigEndian.Uint16(message[0:2]))
+	}
+	length := int(binary.BigEndian.Uint16(message[2:4]))
+	if stunHeaderLength+length > len(message) {
+		return nil, errors.New("truncated stun response")
+	}
+
+	var mappedIP net.IP
+	attributes := message[stunHeaderLength : stunHeaderLength+length]
+	for len(attributes) >= 4 {
+		attributeType := binary.BigEndian.Uint16(attributes[0:2])
+		attributeLength := int(binary.BigEndian.Uint16(attributes[2:4]))
+		if 4+attributeLength > len(attributes) {
+			return nil, errors.New("truncated stun attribute")
+		}
+		value := attributes[4 : 4+attributeLength]
+		switch attributeType {
+		case stunAttrXORMappedAddress:
+			ip, err := parseSTUNAddress(value, message[4:20])
+			if err != nil {
+				return nil, err
+			}
+			return ip, nil
+		case stunAttrMappedAddress:
+			ip, err := parseSTUNAddress(value, nil)
+			if err != nil {
+				return nil, err
+			}
+			mappedIP = ip
+		}
+		//attributes are padded to 4 bytes
+		attributes = attributes[4+(attributeLength+3)/4*4:]
+	}
+	if mappedIP == nil {
+		return nil, errors.New("stun response has no mapped address")
+	}
+	return mappedIP, nil
+}
+
+//parseSTUNAddress - address of a (XOR-)MAPPED-ADDRESS attribute, xorKey is the magic cookie followed by the transaction id
+//for XOR-MAPPED-ADDRESS and nil for MAPPED-ADDRESS
+func parseSTUNAddress(value []byte, xorKey []byte) (net.IP, error) {
+	if len(value) < 4 {
+		return nil, errors.New("invalid stun address attribute")
+	}
+	var ip net.IP
+	switch value[1] {
+	case stunFamilyIPv4:
+		if len(value) < 8 {
+			return nil, errors.New("invalid stun ipv4 address attribute")
+		}
+		ip = net.IP(append([]byte{}, value[4:8]...))
+	case stunFamilyIPv6:
+		if len(value) < 20 {
+			return nil, errors.New("invalid stun ipv6 address attribute")
+		}
+		ip = net.IP(append([]byte{}, value[4:20]...))
+	default:
+		return nil, fmt.Errorf("unknown stun address family 0x%02x", value[1])
+	}
+	for i := range xorKey {
+		if i < len(ip) {
+			ip[i] ^= xorKey[i]
+		}
+	}
+	return ip, nil
+}
+
+//getIPFromSTUNOrProviders - the address seen by the stun server, or the one returned by the ip providers when stun fails
+//(udp blocked, server down), logging which method the address came from
+func getIPFromSTUNOrProviders(ctx context.Context, configuration *Configuration, ipv6 bool) (string, error) {
+	ip, err := getIPFromSTUN(ctx, configuration, ipv6)
+	if err == nil {
+		log.Printf("got ip %s from the stun server %s", ip, configuration.STUNServer)
+		return ip, nil
+	}
+	log.Printf("error when getting ip through stun, falling back to the ip providers :- %s", err.Error())
+
+	providers := configuration.IPProviders
+	if ipv6 {
+		providers = configuration.IPv6Providers
+	}
+	ip, err = getIPFromProviders(ctx, providers, configuration.providerJSONKey(), ipv6)
+	if err == nil {
+		log.Printf("got ip %s from the ip providers", ip)
+	}
+	return ip, err
+}
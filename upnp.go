@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//ssdpAddress - multicast address gateways listen on for ssdp discovery
+const ssdpAddress = "239.255.255.250:1900"
+
+//ssdpTimeout - how long to wait for a gateway to answer the discovery
+const ssdpTimeout = 3 * time.Second
+
+//gatewayClient - client of the upnp requests to the gateway. The gateway is on the local network,
+//so unlike httpClient it never goes through proxyURL or the HTTP_PROXY environment variables.
+var gatewayClient = &http.Client{Timeout: defaultHTTPTimeoutSeconds * time.Second, Transport: newGatewayTransport()}
+
+//newGatewayTransport - the default transport without any proxy
+func newGatewayTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	return transport
+}
+
+//wanServiceTypes - upnp services of an internet gateway device able to tell its external ip
+var wanServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+//upnpService - service entry of a upnp device description
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+//upnpDevice - device of a upnp device description, gateways nest the wan services in embedded devices
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+//upnpDescription - device description xml served at the location returned by the discovery
+type upnpDescription struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+//upnpExternalIPResponse - SOAP response of the GetExternalIPAddress action
+type upnpExternalIPResponse struct {
+	ExternalIP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+}
+
+//findWANService - first wan connection service of the device or of its embedded devices
+func (device *upnpDevice) findWANService() (upnpService, bool) {
+	for _, service := range device.Services {
+		for _, serviceType := range wanServiceTypes {
+			if service.ServiceType == serviceType {
+				return service, true
+			}
+		}
+	}
+	for i := range device.Devices {
+		service, found := device.Devices[i].findWANService()
+		if found {
+			return service, true
+		}
+	}
+	return upnpService{}, false
+}
+
+//getIPFromUPnP - asks the local internet gateway for its external ipv4 address through upnp (GetExternalIPAddress),
+//without depending on any service outside of the network
+func getIPFromUPnP(ctx context.Context) (string, error) {
+	location, err := discoverGateway(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error when discovering the gateway :- %s", err.Error())
+	}
+
+	service, controlURL, err := getWANService(ctx, location)
+	if err != nil {
+		return "", fmt.Errorf("error when reading the gateway description :- %s", err.Error())
+	}
+
+	ip, err := getExternalIPAddress(ctx, service, controlURL)
+	if err != nil {
+		return "", fmt.Errorf("error when asking the gateway for its external ip :- %s", err.Error())
+	}
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil || parsedIP.To4() == nil {
+		return "", fmt.Errorf("gateway returned an invalid ipv4 address :- %q", ip)
+	}
+	//a gateway behind another nat (carrier grade or a second router) only knows its private wan address
+	if parsedIP.IsPrivate() || parsedIP.IsUnspecified() {
+		return "", fmt.Errorf("gateway external ip %s isn't public", ip)
+	}
+	return parsedIP.String(), nil
+}
+
+//discoverGateway - multicasts an ssdp search for the wan services and returns the description location of the first gateway answering
+func discoverGateway(ctx context.Context) (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(ssdpTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	address, err := net.ResolveUDPAddr("udp4", ssdpAddress)
+	if err != nil {
+		return "", err
+	}
+	for _, serviceType := range wanServiceTypes {
+		search := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: " + ssdpAddress + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n" +
+			"ST: " + serviceType + "\r\n\r\n"
+		_, err = conn.WriteTo([]byte(search), address)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	buffer := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return "", errors.New("no gateway answered")
+			}
+			return "", err
+		}
+		for _, line := range strings.Split(string(buffer[:n]), "\r\n") {
+			name, value, found := strings.Cut(line, ":")
+			if found && strings.EqualFold(strings.TrimSpace(name), "location") {
+				return strings.TrimSpace(value), nil
+			}
+		}
+	}
+}
+
+//getWANService - fetches the device description at location and returns its wan service with the absolute control url
+func getWANService(ctx context.Context, location string) (upnpService, string, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return upnpService{}, "", err
+	}
+	resp, err := gatewayClient.Do(request)
+	if err != nil {
+		return upnpService{}, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return upnpService{}, "", fmt.Errorf("%s returned %s", location, resp.Status)
+	}
+
+	var description upnpDescription
+	err = xml.NewDecoder(resp.Body).Decode(&description)
+	if err != nil {
+		return upnpService{}, "", err
+	}
+	service, found := description.Device.findWANService()
+	if !found {
+		return upnpService{}, "", errors.New("gateway has no wan connection service")
+	}
+
+	base := location
+	if description.URLBase != "" {
+		base = description.URLBase
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return upnpService{}, "", err
+	}
+	controlURL, err := baseURL.Parse(service.ControlURL)
+	if err != nil {
+		return upnpService{}, "", err
+	}
+	return service, controlURL.String(), nil
+}
+
+//getExternalIPAddress - calls the GetExternalIPAddress SOAP action of the wan service
+func getExternalIPAddress(ctx context.Context, service upnpService, controlURL string) (string, error) {
+	body := `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:GetExternalIPAddress xmlns:u="` + service.ServiceType + `"/></s:Body></s:Envelope>`
+
+	request, err := http.NewRequestWithContext(ctx, "POST", controlURL, bytes.NewBufferString(body))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	request.Header.Set("SOAPAction", `"`+service.ServiceType+`#GetExternalIPAddress"`)
+
+	resp, err := gatewayClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", controlURL, resp.Status)
+	}
+
+	var response upnpExternalIPResponse
+	err = xml.Unmarshal(responseBody, &response)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response.ExternalIP), nil
+}
+
+//getIPFromUPnPOrProviders - the external ip of the gateway, falling back to the ip providers when upnp isn't available
+func getIPFromUPnPOrProviders(ctx context.Context, configuration *Configuration) (string, error) {
+	ip, err := getIPFromUPnP(ctx)
+	if err == nil {
+		log.Printf("got ip %s from the gateway through upnp", ip)
+		return ip, nil
+	}
+	log.Printf("error when getting ip through upnp, falling back to the ip providers :- %s", err.Error())
+
+	ip, err = getIPFromProviders(ctx, configuration.IPProviders, configuration.providerJSONKey(), false)
+	if err == nil {
+		log.Printf("got ip %s from the ip providers", ip)
+	}
+	return ip, err
+}
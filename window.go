@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+//errUpdatePending - returned by updateRecord when the change waits for the maintenance window
+var errUpdatePending = errors.New("update pending until the maintenance window")
+
+//MaintenanceWindow - daily window (e.g. 00:00 to 06:00) outside of which detected changes are held back as pending.
+//A window ending before it starts spans midnight, e.g. 22:00 to 02:00.
+type MaintenanceWindow struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone"`
+
+	//parsed by validate
+	startMinute int
+	endMinute   int
+	location    *time.Location
+}
+
+//pendingChange - change detected outside of the maintenance window
+type pendingChange struct {
+	content    string
+	detectedAt time.Time
+}
+
+//pendingChanges - changes waiting for the maintenance window, keyed by recordCacheKey
+var pendingChanges = map[string]pendingChange{}
+
+//pendingChangesMutex - records are checked concurrently
+var pendingChangesMutex sync.Mutex
+
+//validate - parses start, end ("HH:MM") and timezone (an IANA name, the local timezone when empty)
+func (window *MaintenanceWindow) validate() error {
+	var err error
+	window.startMinute, err = parseTimeOfDay(window.Start)
+	if err != nil {
+		return fmt.Errorf("maintenanceWindow start must be HH:MM, got %q", window.Start)
+	}
+	window.endMinute, err = parseTimeOfDay(window.End)
+	if err != nil {
+		return fmt.Errorf("maintenanceWindow end must be HH:MM, got %q", window.End)
+	}
+	if window.startMinute == window.endMinute {
+		return errors.New("maintenanceWindow start and end must differ")
+	}
+
+	window.location = time.Local
+	if window.Timezone != "" {
+		window.location, err = time.LoadLocation(window.Timezone)
+		if err != nil {
+			return fmt.Errorf("maintenanceWindow timezone %q is unknown :- %s", window.Timezone, err.Error())
+		}
+	}
+	return nil
+}
+
+//parseTimeOfDay - minutes since midnight of a "HH:MM" time
+func parseTimeOfDay(value string) (int, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+//contains - whether now is inside the window, the start is included and the end isn't
+func (window *MaintenanceWindow) contains(now time.Time) bool {
+	local := now.In(window.location)
+	minute := local.Hour()*60 + local.Minute()
+	if window.startMinute < window.endMinute {
+		return minute >= window.startMinute && minute < window.endMinute
+	}
+	return minute >= window.startMinute || minute < window.endMinute
+}
+
+//String - the window as logged, e.g. 00:00-06:00 Europe/Paris
+func (window *MaintenanceWindow) String() string {
+	return fmt.Sprintf("%s-%s %s", window.Start, window.End, window.location)
+}
+
+//holdForMaintenanceWindow - whether the change of the record to content must wait for the maintenance window.
+//Outside of the window the change is remembered (and logged) as pending, inside it a pending change is logged as applied.
+//Checks forced by -force or SIGUSR1 aren't held back.
+func holdForMaintenanceWindow(configuration *Configuration, record *RecordConfig, recordType string, oldContent string, content string) bool {
+	window := configuration.MaintenanceWindow
+	if window == nil {
+		return false
+	}
+	cacheKey := recordCacheKey(record, recordType)
+
+	pendingChangesMutex.Lock()
+	defer pendingChangesMutex.Unlock()
+	pending, isPending := pendingChanges[cacheKey]
+
+	if configuration.forceUpdate || window.contains(time.Now()) {
+		if isPending {
+			log.Printf("applying pending change of record=%s type=%s detected at %s", record.RecordName, recordType, pending.detectedAt.Format(time.RFC3339))
+			delete(pendingChanges, cacheKey)
+		}
+		return false
+	}
+
+	if !isPending || pending.content != content {
+		log.Printf("pending record=%s type=%s old=%s new=%s until the maintenance window %s", record.RecordName, recordType, oldContent, content, window)
+		pendingChanges[cacheKey] = pendingChange{content: content, detectedAt: time.Now().UTC()}
+	} else {
+		logDebugf("record=%s type=%s still pending until the maintenance window %s", record.RecordName, recordType, window)
+	}
+	return true
+}
+
+//clearPendingChange - forgets the pending change of a record already up to date, e.g. when the ip changed back
+func clearPendingChange(record *RecordConfig, recordType string) {
+	pendingChangesMutex.Lock()
+	defer pendingChangesMutex.Unlock()
+	cacheKey := recordCacheKey(record, recordType)
+	if _, isPending := pendingChanges[cacheKey]; isPending {
+		log.Printf("dropping pending change of record=%s type=%s, it's up to date again", record.RecordName, recordType)
+		delete(pendingChanges, cacheKey)
+	}
+}
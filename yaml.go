@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+//yamlLine - a line of a yaml document without its indentation and comment
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+//yamlScalar - a plain (unquoted) scalar, its text is kept until it's known whether it decodes into a string,
+//so a zone identifier or a chat id made of digits isn't turned into a number
+type yamlScalar struct {
+	text  string
+	value interface{}
+}
+
+//MarshalJSON - the scalar as what it reads as, null, a boolean, a number or its text
+func (scalar yamlScalar) MarshalJSON() ([]byte, error) {
+	return json.Marshal(scalar.value)
+}
+
+//String - the scalar as written
+func (scalar yamlScalar) String() string {
+	return scalar.text
+}
+
+//decodeYAML - decodes the subset of yaml needed for a configuration file into maps, slices and scalars that encoding/json can marshal:
+//block mappings and sequences (including sequences of mappings), flow sequences of scalars, quoted and plain scalars and # comments.
+//Anchors, tags, multi-line and block scalars aren't supported.
+func decodeYAML(data []byte) (interface{}, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		if strings.TrimLeft(raw, " \t") != strings.TrimLeft(raw, " ") {
+			return nil, fmt.Errorf("line %d :- tabs can't be used for indentation", i+1)
+		}
+		text := strings.TrimRight(stripYAMLComment(raw), " \t")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		lines = append(lines, yamlLine{number: i + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	if len(lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+
+	value, next, err := parseYAMLNode(lines, 0, lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if next < len(lines) {
+		return nil, fmt.Errorf("line %d :- unexpected indentation", lines[next].number)
+	}
+	return value, nil
+}
+
+//stripYAMLComment - the line without a # comment, a # inside quotes or not preceded by a space is kept
+func stripYAMLComment(line string) string {
+	var quote rune
+	for i, char := range line {
+		switch {
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			}
+		case char == '"' || char == '\'':
+			quote = char
+		case char == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+//parseYAMLNode - parses the mapping or sequence starting at lines[i] with the given indentation, returns the index of the line after it
+func parseYAMLNode(lines []yamlLine, i int, indent int) (interface{}, int, error) {
+	if isYAMLSequenceItem(lines[i].text) {
+		return parseYAMLSequence(lines, i, indent)
+	}
+	return parseYAMLMapping(lines, i, indent)
+}
+
+//isYAMLSequenceItem - whether the text starts a "- item" entry
+func isYAMLSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+//parseYAMLSequence - parses the "- item" entries at the given indentation
+func parseYAMLSequence(lines []yamlLine, i int, indent int) (interface{}, int, error) {
+	sequence := []interface{}{}
+	for i < len(lines) && lines[i].indent == indent && isYAMLSequenceItem(lines[i].text) {
+		line := lines[i]
+		item := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+
+		switch {
+		case item == "":
+			//the item is the nested node on the following lines
+			if i+1 >= len(lines) || lines[i+1].indent <= indent {
+				sequence = append(sequence, nil)
+				i++
+				continue
+			}
+			value, next, err := parseYAMLNode(lines, i+1, lines[i+1].indent)
+			if err != nil {
+				return nil, 0, err
+			}
+			sequence = append(sequence, value)
+			i = next
+		case isYAMLSequenceItem(item) || isYAMLMappingEntry(item):
+			//"- name: value" starts a mapping indented at the position of name, parse it as if name was on its own line
+			itemIndent := line.indent + len(line.text) - len(item)
+			nested := append([]yamlLine{{number: line.number, indent: itemIndent, text: item}}, lines[i+1:]...)
+			value, next, err := parseYAMLNode(nested, 0, itemIndent)
+			if err != nil {
+				return nil, 0, err
+			}
+			sequence = append(sequence, value)
+			i += next
+		default:
+			value, err := parseYAMLValue(item, line.number)
+			if err != nil {
+				return nil, 0, err
+			}
+			sequence = append(sequence, value)
+			i++
+		}
+	}
+	if i < len(lines) && lines[i].indent > indent {
+		return nil, 0, fmt.Errorf("line %d :- unexpected indentation", lines[i].number)
+	}
+	return sequence, i, nil
+}
+
+//isYAMLMappingEntry - whether the text is a "key: value" (or "key:") entry
+func isYAMLMappingEntry(text string) bool {
+	_, _, found := splitYAMLMappingEntry(text)
+	return found
+}
+
+//splitYAMLMappingEntry - splits "key: value" on the first colon followed by a space or ending the text, outside of quotes
+func splitYAMLMappingEntry(text string) (string, string, bool) {
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return "", "", false
+	}
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		switch {
+		case quote != 0:
+			if text[i] == quote {
+				quote = 0
+			}
+		case text[i] == '"' || text[i] == '\'':
+			quote = text[i]
+		case text[i] == ':' && (i == len(text)-1 || text[i+1] == ' '):
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+//parseYAMLMapping - parses the "key: value" entries at the given indentation
+func parseYAMLMapping(lines []yamlLine, i int, indent int) (interface{}, int, error) {
+	mapping := map[string]interface{}{}
+	for i < len(lines) && lines[i].indent == indent && !isYAMLSequenceItem(lines[i].text) {
+		line := lines[i]
+		key, value, found := splitYAMLMappingEntry(line.text)
+		if !found {
+			return nil, 0, fmt.Errorf("line %d :- expected \"key: value\", got %q", line.number, line.text)
+		}
+		unquotedKey, err := parseYAMLValue(key, line.number)
+		if err != nil {
+			return nil, 0, err
+		}
+		key = fmt.Sprint(unquotedKey)
+		if _, duplicate := mapping[key]; duplicate {
+			return nil, 0, fmt.Errorf("line %d :- %s is set twice", line.number, key)
+		}
+		i++
+
+		if value != "" {
+			mapping[key], err = parseYAMLValue(value, line.number)
+			if err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+
+		//the value is the nested node on the following lines, a sequence may be at the same indentation as its key
+		switch {
+		case i < len(lines) && lines[i].indent > indent:
+			mapping[key], i, err = parseYAMLNode(lines, i, lines[i].indent)
+		case i < len(lines) && lines[i].indent == indent && isYAMLSequenceItem(lines[i].text):
+			mapping[key], i, err = parseYAMLSequence(lines, i, indent)
+		default:
+			mapping[key] = nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if i < len(lines) && lines[i].indent > indent {
+		return nil, 0, fmt.Errorf("line %d :- unexpected indentation", lines[i].number)
+	}
+	return mapping, i, nil
+}
+
+//parseYAMLValue - parses an inline value, a flow sequence or a scalar
+func parseYAMLValue(text string, lineNumber int) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(text, "|") || strings.HasPrefix(text, ">"):
+		return nil, fmt.Errorf("line %d :- block scalars aren't supported, quote the value instead", lineNumber)
+	case strings.HasPrefix(text, "&") || strings.HasPrefix(text, "*") || strings.HasPrefix(text, "!"):
+		return nil, fmt.Errorf("line %d :- anchors, aliases and tags aren't supported", lineNumber)
+	case text == "{}":
+		return map[string]interface{}{}, nil
+	case strings.HasPrefix(text, "{"):
+		return nil, fmt.Errorf("line %d :- flow mappings aren't supported, use a block mapping instead", lineNumber)
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("line %d :- unterminated flow sequence", lineNumber)
+		}
+		sequence := []interface{}{}
+		for _, item := range splitYAMLFlowSequence(text[1 : len(text)-1]) {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			value, err := parseYAMLValue(item, lineNumber)
+			if err != nil {
+				return nil, err
+			}
+			sequence = append(sequence, value)
+		}
+		return sequence, nil
+	}
+	return parseYAMLScalar(text, lineNumber)
+}
+
+//splitYAMLFlowSequence - splits the items of a flow sequence on the commas outside of quotes
+func splitYAMLFlowSequence(text string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(text); i++ {
+		switch {
+		case quote != 0:
+			if text[i] == quote {
+				quote = 0
+			}
+		case text[i] == '"' || text[i] == '\'':
+			quote = text[i]
+		case text[i] == ',':
+			items = append(items, text[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, text[start:])
+}
+
+//parseYAMLScalar - a quoted string, null, a boolean, a number or else a plain string
+func parseYAMLScalar(text string, lineNumber int) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(text, "\""):
+		value, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d :- invalid double quoted string %s", lineNumber, text)
+		}
+		return value, nil
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return nil, fmt.Errorf("line %d :- invalid single quoted string %s", lineNumber, text)
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	}
+
+	switch text {
+	case "~", "null", "Null", "NULL":
+		return yamlScalar{text: text}, nil
+	case "true", "True", "TRUE":
+		return yamlScalar{text: text, value: true}, nil
+	case "false", "False", "FALSE":
+		return yamlScalar{text: text, value: false}, nil
+	}
+	if integer, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return yamlScalar{text: text, value: integer}, nil
+	}
+	if number, err := strconv.ParseFloat(text, 64); err == nil && !strings.ContainsAny(text, "xXnN") {
+		return yamlScalar{text: text, value: number}, nil
+	}
+	return yamlScalar{text: text, value: text}, nil
+}
+
+//yamlTextForStrings - replaces the plain scalars decoding into a string field of target by their text, following the json tags,
+//e.g. "zoneIdentifier: 12345" becomes "12345" instead of the number. Nulls are kept and anything else decodes as it reads.
+func yamlTextForStrings(value interface{}, target reflect.Type) interface{} {
+	for target.Kind() == reflect.Ptr {
+		target = target.Elem()
+	}
+	switch node := value.(type) {
+	case yamlScalar:
+		if target.Kind() == reflect.String && node.value != nil {
+			return node.text
+		}
+	case []interface{}:
+		if target.Kind() == reflect.Slice || target.Kind() == reflect.Array {
+			for i, item := range node {
+				node[i] = yamlTextForStrings(item, target.Elem())
+			}
+		}
+	case map[string]interface{}:
+		if target.Kind() == reflect.Struct {
+			for key, item := range node {
+				if field, found := jsonField(target, key); found {
+					node[key] = yamlTextForStrings(item, field.Type)
+				}
+			}
+		}
+	}
+	return value
+}
+
+//jsonField - the field of the struct type encoding/json decodes the key into, an exact match of the json name first then regardless of case
+func jsonField(target reflect.Type, key string) (reflect.StructField, bool) {
+	var folded *reflect.StructField
+	for i := 0; i < target.NumField(); i++ {
+		field := target.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.PkgPath != "" || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if name == key {
+			return field, true
+		}
+		if folded == nil && strings.EqualFold(name, key) {
+			folded = &field
+		}
+	}
+	if folded == nil {
+		return reflect.StructField{}, false
+	}
+	return *folded, true
+}
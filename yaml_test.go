@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDecodeYAML(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		want     string
+	}{
+		{
+			name:     "nested mappings",
+			document: "maintenanceWindow:\n  start: \"02:00\"\n  end: \"04:00\"\n  nested:\n    deeper: value\nzoneName: example.com\n",
+			want:     `{"maintenanceWindow":{"end":"04:00","nested":{"deeper":"value"},"start":"02:00"},"zoneName":"example.com"}`,
+		},
+		{
+			name:     "sequence of mappings",
+			document: "records:\n  - name: home.example.com\n    ttl: auto\n  - name: nas.example.com\n    proxy: true\n",
+			want:     `{"records":[{"name":"home.example.com","ttl":"auto"},{"name":"nas.example.com","proxy":true}]}`,
+		},
+		{
+			name:     "sequence at the indentation of its key",
+			document: "ipProviders:\n- https://one.example/\n- https://two.example/\n",
+			want:     `{"ipProviders":["https://one.example/","https://two.example/"]}`,
+		},
+		{
+			name:     "comments after values",
+			document: "# home connection\nzoneName: example.com # the zone\nrecordName: \"home # not a comment\"\nurl: https://example.com/#anchor\n",
+			want:     `{"recordName":"home # not a comment","url":"https://example.com/#anchor","zoneName":"example.com"}`,
+		},
+		{
+			name:     "quoted and unquoted strings",
+			document: "plain: some text\ndouble: \"a \\\"quoted\\\" value\"\nsingle: 'it''s'\nquotedNumber: \"123\"\n",
+			want:     `{"double":"a \"quoted\" value","plain":"some text","quotedNumber":"123","single":"it's"}`,
+		},
+		{
+			name:     "flow sequences",
+			document: "tags: [home, \"a, b\", 'c']\nempty: []\n",
+			want:     `{"empty":[],"tags":["home","a, b","c"]}`,
+		},
+		{
+			name:     "numbers",
+			document: "intervalSeconds: 60\nnegative: -5\nratio: 1.5\nhex: 0x1F\n",
+			want:     `{"hex":"0x1F","intervalSeconds":60,"negative":-5,"ratio":1.5}`,
+		},
+		{
+			name:     "booleans and null",
+			document: "proxy: true\ndryRun: False\nipv6: TRUE\nzoneName: ~\ncomment: null\n",
+			want:     `{"comment":null,"dryRun":false,"ipv6":true,"proxy":true,"zoneName":null}`,
+		},
+		{
+			name:     "empty document",
+			document: "# nothing set\n---\n",
+			want:     `{}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			document, err := decodeYAML([]byte(test.document))
+			if err != nil {
+				t.Fatalf("decodeYAML() :- %s", err.Error())
+			}
+			got, err := json.Marshal(document)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("decodeYAML() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		want     string
+	}{
+		{name: "deeper indentation after a value", document: "zoneName: example.com\n   recordName: home\n", want: "line 2 :- unexpected indentation"},
+		{name: "shallower indentation in a nested mapping", document: "maintenanceWindow:\n    start: \"02:00\"\n  end: \"04:00\"\n", want: "line 3 :- unexpected indentation"},
+		{name: "misaligned sequence item", document: "ipProviders:\n  - https://one.example/\n    - https://two.example/\n", want: "line 3 :- unexpected indentation"},
+		{name: "tab indentation", document: "maintenanceWindow:\n\tstart: \"02:00\"\n", want: "line 2 :- tabs can't be used for indentation"},
+		{name: "not a mapping entry", document: "zoneName: example.com\njust text\n", want: "line 2 :- expected \"key: value\""},
+		{name: "key set twice", document: "zoneName: a\nzoneName: b\n", want: "line 2 :- zoneName is set twice"},
+		{name: "unterminated flow sequence", document: "tags: [home, nas\n", want: "line 1 :- unterminated flow sequence"},
+		{name: "block scalar", document: "comment: |\n  text\n", want: "line 1 :- block scalars aren't supported"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := decodeYAML([]byte(test.document))
+			if err == nil {
+				t.Fatalf("decodeYAML() accepted %q", test.document)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("decodeYAML() error %q, want %q", err.Error(), test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeYAMLConfigKeepsNumericStrings(t *testing.T) {
+	document := `apiToken: token
+zoneIdentifier: 12345
+telegramChatID: -100123456
+smtpPassword: 0123456
+intervalSeconds: 60
+proxy: true
+ttl: 120
+records:
+  - name: home.example.com
+    zoneIdentifier: 67890
+    ttl: auto
+    tags: [home, 2024]
+    priority: 10
+`
+	var configuration Configuration
+	err := decodeYAMLConfig(strings.NewReader(document), &configuration)
+	if err != nil {
+		t.Fatalf("decodeYAMLConfig() :- %s", err.Error())
+	}
+	if configuration.ZoneIdentifier != "12345" || configuration.TelegramChatID != "-100123456" || configuration.SMTPPassword != "0123456" {
+		t.Errorf("numeric looking strings not kept as written :- zoneIdentifier %q, telegramChatID %q, smtpPassword %q",
+			configuration.ZoneIdentifier, configuration.TelegramChatID, configuration.SMTPPassword)
+	}
+	if configuration.IntervalSeconds != 60 || !configuration.EnableProxy || configuration.TTL != 120 {
+		t.Errorf("numbers and booleans not decoded :- intervalSeconds %d, proxy %t, ttl %d",
+			configuration.IntervalSeconds, configuration.EnableProxy, configuration.TTL)
+	}
+	if len(configuration.Records) != 1 {
+		t.Fatalf("%d records, want 1", len(configuration.Records))
+	}
+	record := configuration.Records[0]
+	if record.ZoneIdentifier != "67890" || record.TTL != ttlAutomatic || record.Priority == nil || *record.Priority != 10 {
+		t.Errorf("record not decoded :- %+v", record)
+	}
+	if len(record.Tags) != 2 || record.Tags[1] != "2024" {
+		t.Errorf("tags %q, want home and 2024", record.Tags)
+	}
+}